@@ -3,245 +3,4700 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"iter"
+	"log/syslog"
+	"maps"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+	"unsafe"
 )
 
-// logf prints a formatted message to stdout if verbose mode is enabled.
+// Exit codes of multirun.
+const (
+	exitSuccess      = 0
+	exitChildFailure = 1 // at least one child exited abnormally
+	exitUsage        = 2 // invalid options or commands
+	exitStartup      = 3 // nothing could be started
+	exitNoCommands   = 4 // no command left once blank ones are dropped
+)
+
+// logOutput receives the messages of logf. It defaults to stderr, which
+// keeps stdout for the output of the children.
+var logOutput io.Writer = os.Stderr
+
+// logf prints a formatted message to logOutput if verbose mode is enabled.
 func logf(verbose bool, format string, v ...interface{}) {
 	if verbose {
-		fmt.Printf("multirun: "+format+"\n", v...)
+		fmt.Fprintf(logOutput, "multirun: "+format+"\n", v...)
 	}
 }
 
 // setSubreaper ensures that multirun adopts any orphaned grandchild processes.
-func setSubreaper(verbose bool) {
+func setSubreaper() error {
 	// From linux/prctl.h, since this is not exported by the standard syscall package.
 	const PR_SET_CHILD_SUBREAPER = 36
 	// We make a raw syscall to avoid depending on golang.org/x/sys
 	// and to keep the project self-contained.
 	_, _, errno := syscall.Syscall(syscall.SYS_PRCTL, PR_SET_CHILD_SUBREAPER, 1, 0)
 	if errno != 0 {
-		logf(verbose, "failed to register as subreaper (errno: %d), subchildren exit status might be ignored.", errno)
-	} else {
-		logf(verbose, "successfully registered as subreaper.")
+		return errno
+	}
+	return nil
+}
+
+// process is a started child, as seen by the event loop. The production
+// implementation is execProcess; tests substitute fakes to drive the event
+// loop without spawning anything.
+type process interface {
+	Start() error
+	Pid() int
+	// Wait blocks until the process exits and returns its exit status as
+	// exec.Cmd.Wait does.
+	Wait() error
+	// Signal sends sig to the process group of the process.
+	Signal(sig syscall.Signal) error
+	// Rusage returns the resource usage of the exited process, or nil.
+	Rusage() *syscall.Rusage
+}
+
+// execProcess runs a command through exec.Cmd.
+type execProcess struct {
+	cmd     *exec.Cmd
+	adopted bool
+	pgid    int // process group signaled, the pid when zero
+}
+
+// newExecProcess prepares a shell script, as built by shellScript, run in its
+// own process group. A nil env inherits the environment of multirun.
+func newExecProcess(script string, attr *syscall.SysProcAttr, env []string, stdin io.Reader, stdout, stderr io.Writer) process {
+	cmd := exec.Command("sh", "-c", script)
+	cmd.SysProcAttr = attr
+	cmd.Env = env
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = outputWaitDelay
+	return &execProcess{cmd: cmd}
+}
+
+// outputWaitDelay is how long, once a child exited, the pipes carrying its
+// output to multirun are read before being closed. Only the exit of the
+// child matters, not the end of its output: a child may close its stdout
+// early and run on, and a descendant it left in the background may keep the
+// pipes open long after the child is gone.
+const outputWaitDelay = time.Second
+
+// adoptExecProcess takes over a running child of multirun that it did not
+// start itself: one started by a previous multirun image, or the daemon a
+// -forking command turned into. The latter may not lead its process group.
+func adoptExecProcess(command string, pid int) *execProcess {
+	cmd := exec.Command("sh", "-c", "exec "+command)
+	cmd.Process, _ = os.FindProcess(pid)
+	pgid, _ := syscall.Getpgid(pid)
+	return &execProcess{cmd: cmd, adopted: true, pgid: pgid}
+}
+
+func (p *execProcess) Start() error { return p.cmd.Start() }
+func (p *execProcess) Pid() int     { return p.cmd.Process.Pid }
+
+// Wait blocks until the process exits. Processes adopted from a previous
+// multirun image were not started by cmd, so they are waited on directly.
+func (p *execProcess) Wait() error {
+	if !p.adopted {
+		// The child succeeded, but its output pipes had to be closed.
+		if err := p.cmd.Wait(); !errors.Is(err, exec.ErrWaitDelay) {
+			return err
+		}
+		return nil
+	}
+	state, err := p.cmd.Process.Wait()
+	if err != nil {
+		return err
+	}
+	p.cmd.ProcessState = state
+	if !state.Success() {
+		return &exec.ExitError{ProcessState: state}
+	}
+	return nil
+}
+
+func (p *execProcess) Signal(sig syscall.Signal) error {
+	if p.pgid != 0 {
+		return syscall.Kill(-p.pgid, sig)
+	}
+	return syscall.Kill(-p.cmd.Process.Pid, sig)
+}
+
+func (p *execProcess) Rusage() *syscall.Rusage {
+	if p.cmd.ProcessState == nil {
+		return nil
 	}
+	ru, _ := p.cmd.ProcessState.SysUsage().(*syscall.Rusage)
+	return ru
 }
 
 // subprocess holds the state of a single child process.
 type subprocess struct {
-	cmd     *exec.Cmd
-	command string
-	up      bool
-	err     error
+	process  process
+	command  string
+	name     string
+	priority int
+	optional bool // the exit of an optional subprocess never cascades
+	forking  bool // a successful exit hands over to the daemon it forked
+	up       bool
+	stopping bool
+	restart  bool // stopped to be launched again
+	restarts int
+	started  time.Time
+	err      error
+	measured bool // whether the kernel reported the usage below
+	userTime time.Duration
+	sysTime  time.Duration
+	maxRSS   int64 // in KiB
+	outputs  []*lineWriter
+	rate     *rateLimit
+	tail     *tailBuffer
+	loggers  []*syslog.Writer
+	ptyDone  chan struct{} // closed once the output of the pty is copied
+	killSent bool          // whether multirun sent SIGKILL to the subprocess
+	grace    time.Duration // how long a shutdown waits before killing it
+	// signalMap replaces the signals sent on shutdown and relays.
+	signalMap map[syscall.Signal]syscall.Signal
+	// exited, exitCode and exitSignal are valid once the subprocess is no
+	// longer up.
+	exited     time.Time
+	exitCode   int
+	exitSignal syscall.Signal
+	// lastExitCode is the exit code of the previous run, once restarted.
+	lastExitCode *int
+	// possibleOOM is set when the subprocess died of a SIGKILL that did not
+	// come from multirun.
+	possibleOOM bool
+	// meanings describes the exit codes of the subprocess, from -exit-meaning.
+	meanings map[int]string
+	// restartReplies are the control connections waiting for the restart.
+	restartReplies []chan string
+	// activity is nil unless the output goes through multirun.
+	activity *outputActivity
+	// ptyMaster is the master end of the pty of the subprocess with -pty.
+	ptyMaster *os.File
+	// ready is closed once a line of output matches the -ready-pattern of
+	// the subprocess, nil without one.
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+// recordUsage stores the resource usage reported by the kernel for the exited
+// process.
+func (p *subprocess) recordUsage() {
+	if ru := p.process.Rusage(); ru != nil {
+		p.measured = true
+		p.userTime = time.Duration(ru.Utime.Nano())
+		p.sysTime = time.Duration(ru.Stime.Nano())
+		p.maxRSS = ru.Maxrss
+	}
+}
+
+// flushOutput forwards any output still buffered for the process, such as
+// a last line without a trailing newline.
+func (p *subprocess) flushOutput() {
+	for _, w := range p.outputs {
+		w.Flush()
+	}
+	if p.rate != nil {
+		p.rate.report(os.Stderr)
+	}
+	for _, logger := range p.loggers {
+		logger.Close()
+	}
+}
+
+// exitDescription tells how the exited subprocess ended, e.g. "exit code 3"
+// or "SIGKILL", followed by the -exit-meaning of the exit code if any, e.g.
+// "exit code 2: config error".
+func (p *subprocess) exitDescription() string {
+	description := fmt.Sprintf("exit code %d", p.exitCode)
+	if p.exitSignal != 0 {
+		description = signalName(p.exitSignal)
+	}
+	if meaning := p.meanings[p.exitCode]; meaning != "" {
+		description += ": " + meaning
+	}
+	return description
+}
+
+// failureEnvPrefix starts the environment variables that describe a failure
+// to the -on-failure hook.
+const failureEnvPrefix = "MULTIRUN_FAILED_"
+
+// failureEnv describes the exited subprocess to the -on-failure hook.
+func (p *subprocess) failureEnv() []string {
+	env := []string{
+		failureEnvPrefix + "NAME=" + p.name,
+		failureEnvPrefix + "COMMAND=" + p.command,
+		failureEnvPrefix + "PID=" + strconv.Itoa(p.process.Pid()),
+		failureEnvPrefix + "EXIT_CODE=" + strconv.Itoa(p.exitCode),
+		failureEnvPrefix + "DESCRIPTION=" + p.exitDescription(),
+	}
+	if p.exitSignal != 0 {
+		env = append(env, failureEnvPrefix+"SIGNAL="+signalName(p.exitSignal))
+	}
+	return env
+}
+
+// runTime formats how long the exited subprocess ran for -timing, in seconds
+// with milliseconds, so that even the shortest run keeps its unit.
+func (p *subprocess) runTime() string {
+	return fmt.Sprintf("%.3fs", p.exited.Sub(p.started).Seconds())
+}
+
+// usage formats the recorded resource usage for logging.
+func (p *subprocess) usage() string {
+	return fmt.Sprintf("user %s, system %s, max rss %d KiB",
+		p.userTime.Round(time.Millisecond), p.sysTime.Round(time.Millisecond), p.maxRSS)
+}
+
+// resourceUsage is the resource usage of an exited subprocess, for the
+// -report and the status.
+type resourceUsage struct {
+	UserSeconds   float64 `json:"userSeconds"`
+	SystemSeconds float64 `json:"systemSeconds"`
+	MaxRSSKiB     int64   `json:"maxRssKiB"`
+}
+
+// resourceUsage returns the recorded resource usage, or nil while the
+// subprocess runs or when the kernel reported none.
+func (p *subprocess) resourceUsage() *resourceUsage {
+	if p.up || !p.measured {
+		return nil
+	}
+	return &resourceUsage{UserSeconds: p.userTime.Seconds(), SystemSeconds: p.sysTime.Seconds(), MaxRSSKiB: p.maxRSS}
+}
+
+// clock is the source of time of the event loop, the hooks and the waits
+// before startup. The production implementation is realClock; tests
+// substitute a fake to fire the timers of -grace, -restart-delay,
+// -on-failure-timeout and the others without waiting for them.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	// AfterFunc calls f in its own goroutine after d, as time.AfterFunc does.
+	AfterFunc(d time.Duration, f func()) timer
+	// NewTicker returns a channel receiving the time every d, and the
+	// function stopping it.
+	NewTicker(d time.Duration) (<-chan time.Time, func())
+}
+
+// timer is a call scheduled by clock.AfterFunc.
+type timer interface {
+	// Stop cancels the call, and reports whether it did before it happened.
+	Stop() bool
+}
+
+// realClock is the clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                            { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time    { return time.After(d) }
+func (realClock) AfterFunc(d time.Duration, f func()) timer { return time.AfterFunc(d, f) }
+
+func (realClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
 }
 
+// shutdownWaitPoll is how often -shutdown-wait-file is checked once the grace
+// period expired, and -shutdown-ready-file while it runs.
+const shutdownWaitPoll = 100 * time.Millisecond
+
 // multirun holds the application's state and configuration.
 type multirun struct {
-	verbose      bool
+	verbose   bool
+	quiet     bool
+	initMode  bool
+	keepGoing bool
+	grep      *regexp.Regexp
+	prefix    prefixFormat
+	maxRate   int
+	tailLines int
+	stderr    io.Writer
+	pidOutput io.Writer
+	// newProcess prepares the process of a command; see newExecProcess.
+	newProcess   func(script string, attr *syscall.SysProcAttr, env []string, stdin io.Reader, stdout, stderr io.Writer) process
+	clock        clock
+	descendants  func() []int // finds the escaped descendants; see escapedDescendants
+	env          []string     // nil to inherit the environment of multirun
+	envFlags     []string     // the options given as variables, passed on to an upgrade
+	stdinTarget  string
+	statusSignal syscall.Signal
+	statusFile   string
+	exitCodeDir  string
+	tickSignal   syscall.Signal
+	tickInterval time.Duration
+	grace        time.Duration
+	warmup       time.Duration
+	reportAfter  time.Duration
+	heartbeat    time.Duration
+	waitFile     string // -shutdown-wait-file
+	readyToDie   map[string]string
+	preStop      syscall.Signal
+	preStopDelay time.Duration
+	forcedStop   syscall.Signal
+	stopCause    string // what started the shutdown, empty if none did
+	groupFailed  bool   // the shutdown was started by a failure
+	killedAfter  time.Duration
+	useSyslog    bool
+	pty          bool
+	trackOutput  bool
+	timing       bool
+	systemdScope bool
+	stdbuf       bool
+	syslogStdout syslog.Priority
+	syslogStderr syslog.Priority
+	cgroup       *cgroup // nil without -cgroup
+	watches      []watchSpec
+	watcher      *watcher // nil without -watch
+	tui          *tui     // nil without -tui
+	stopPriority map[string]int
+	credentials  map[string]*syscall.Credential
+	niceness     map[string]int
+	umasks       map[string]int
+	rlimits      map[string][]rlimit
+	cpus         map[string]*cpuSet
+	graces       map[string]time.Duration
+	delays       map[string]time.Duration // -restart-delay
+	interpreters map[string]interpreter
+	essential    map[string]bool
+	critical     map[string]bool // nil without -critical
+	leader       string
+	exitPolicy   string
+	restartCodes map[string]map[int]bool
+	maxRestarts  int
+	patterns     map[string]*regexp.Regexp
+	readyTimeout time.Duration
+	// pending are the commands left to start once gate is ready, with their
+	// names.
+	pending      []string
+	pendingNames []string
+	gate         *subprocess
+	startFailed  bool
+	forking      map[string]bool
+	signalMaps   map[string]map[syscall.Signal]syscall.Signal
+	okCodes      map[int]bool
+	okSignals    map[syscall.Signal]bool
+	exitMeanings map[string]map[int]string
+	stopSignal   syscall.Signal
 	subprocesses map[int]*subprocess
 	exitChan     chan *subprocess
 	sigChan      chan os.Signal
+	control      net.Listener
+	controlChan  chan controlRequest
+	done         chan struct{}
+	onReady      string
+	readyFile    string
+	onFailure    string
+	hookTimeout  time.Duration
+	hooksMu      sync.Mutex
+	hooks        map[int]bool   // running hooks, true for those with a timeout
+	hookWait     sync.WaitGroup // hooks with a timeout, waited for on exit
+}
+
+// newMultirun creates an application instance with the default settings.
+func newMultirun(verbose bool) *multirun {
+	app := &multirun{
+		verbose:      verbose,
+		stderr:       os.Stderr,
+		newProcess:   newExecProcess,
+		clock:        realClock{},
+		stopPriority: make(map[string]int),
+		credentials:  make(map[string]*syscall.Credential),
+		niceness:     make(map[string]int),
+		umasks:       make(map[string]int),
+		rlimits:      make(map[string][]rlimit),
+		cpus:         make(map[string]*cpuSet),
+		graces:       make(map[string]time.Duration),
+		delays:       make(map[string]time.Duration),
+		interpreters: make(map[string]interpreter),
+		patterns:     make(map[string]*regexp.Regexp),
+		restartCodes: make(map[string]map[int]bool),
+		readyToDie:   make(map[string]string),
+		essential:    make(map[string]bool),
+		forking:      make(map[string]bool),
+		exitMeanings: make(map[string]map[int]string),
+		okCodes:      map[int]bool{0: true},
+		okSignals:    map[syscall.Signal]bool{syscall.SIGINT: true, syscall.SIGTERM: true},
+		signalMaps:   make(map[string]map[syscall.Signal]syscall.Signal),
+		subprocesses: make(map[int]*subprocess),
+		exitChan:     make(chan *subprocess, 1),
+		sigChan:      make(chan os.Signal, 1),
+		controlChan:  make(chan controlRequest),
+		done:         make(chan struct{}),
+		hooks:        make(map[int]bool),
+	}
+	app.descendants = app.escapedDescendants
+	return app
 }
 
 func main() {
 	// 1. Define and parse command-line flags immediately.
-	var verbose bool
+	var verbose, quiet, noSubreaper, requireSubreaper, initMode, useCgroup, pty, keepGoing, trackOutput, dedupe bool
+	var systemdScope, script, tuiMode, stdbuf, forceKill, timing bool
+	var tickSignal, grep, controlSocket, logTo, template, stderrFile string
+	var onFailure, send string
+	var onReady, readyFile, printPids, stdin, statusSignal, statusFile, shutdownWaitFile, critical, forking string
+	var report, envFile, syslogSpec, prefixSpec, showConfig, chdir, waitForAddr, waitForFile string
+	var okCodes, okSignals, exitCodeDir, leader, exitPolicy string
+	var tickInterval, grace, preStopDelay, warmup, hookTimeout, reportAfter, heartbeat, waitTimeout time.Duration
+	var readyTimeout time.Duration
+	var preStop, stopSignal string
+	var maxRate, tailLines, restartGroup, maxRestarts int
+	stopPriority := perCommand{}
+	users := perCommand{}
+	niceness := perCommand{}
+	umasks := perCommand{}
+	rlimits := perCommand{}
+	cpus := perCommand{}
+	graces := perCommand{}
+	delays := perCommand{}
+	interpreters := perCommand{}
+	readyToDie := perCommand{}
+	readyPatterns := perCommand{}
+	restartOn := perCommand{}
+	essential := perCommand{}
+	signalMaps := perCommand{}
+	exitMeanings := perCommand{}
+	var watches watchSpecs
 	flag.BoolVar(&verbose, "v", false, "verbose mode")
+	flag.StringVar(&chdir, "chdir", "", "directory to change to before anything else, from which the commands and relative paths are resolved")
+	flag.StringVar(&logTo, "log-output", "stderr", "where verbose messages go: stderr or stdout")
+	flag.BoolVar(&initMode, "init", false, "init mode: keep running until signaled, never cascade on child exit, reap orphans")
+	flag.BoolVar(&keepGoing, "keep-going", false, "let the others run to completion when a command exits, and list all the failures at the end")
+	flag.BoolVar(&keepGoing, "no-cascade", false, "same as -keep-going")
+	flag.BoolVar(&noSubreaper, "no-subreaper", false, "do not register as a subreaper for orphaned grandchildren")
+	flag.BoolVar(&requireSubreaper, "require-subreaper", false, "exit if multirun cannot register as a subreaper")
+	flag.BoolVar(&useCgroup, "cgroup", false, "run the children in a transient cgroup v2, killed as a whole on exit")
+	flag.BoolVar(&systemdScope, "systemd-scope", false, "run each child in a transient systemd scope unit, for resource accounting by systemd")
+	flag.BoolVar(&tuiMode, "tui", false, "show a live table of the commands, with keys to restart or stop them, when stdout is a terminal")
+	flag.BoolVar(&stdbuf, "stdbuf", false, "run the commands through stdbuf so that their output is line buffered")
+	flag.BoolVar(&pty, "pty", false, "run each child in its own pseudo-terminal, for programs that behave differently on a terminal")
+	flag.BoolVar(&quiet, "quiet", false, "discard the output of all children")
+	flag.BoolVar(&timing, "timing", false, "print how long each command ran when it exits, and for all of them at the end")
+	flag.BoolVar(&trackOutput, "track-output", false, "count the output lines of each command and note the time of the last one, shown in the status")
+	flag.StringVar(&stderrFile, "stderr-file", "", "append the stderr of all children to this file instead of multirun's stderr")
+	flag.StringVar(&prefixSpec, "prefix-format", "", "prefix of each line of child output, with {name}, {pid}, {command} and {time} placeholders")
+	flag.StringVar(&grep, "grep", "", "only show the output lines of children matching this regular expression")
+	flag.IntVar(&maxRate, "max-output-rate", 0, "maximum number of output lines per second shown for each child (0 for unlimited)")
+	flag.BoolVar(&dedupe, "dedupe", false, "run identical commands only once, with a warning")
+	flag.BoolVar(&script, "script", false, "read the commands from the given files, one per line, instead of taking them as arguments")
+	flag.StringVar(&template, "template", "", "run this command once per argument, replacing %s (or %d) with the argument")
+	flag.StringVar(&okCodes, "ok-codes", "0", "comma-separated exit codes and ranges, e.g. 0,130,200-210, that count as a normal exit")
+	flag.StringVar(&okSignals, "ok-signals", "INT,TERM", "comma-separated signals that count as a normal exit when they kill a command")
+	flag.DurationVar(&grace, "grace", 0, "once a shutdown starts, kill the processes still running after this long (0 waits forever)")
+	flag.DurationVar(&heartbeat, "heartbeat", 0, "log how many processes are up, and for how long, at this interval")
+	flag.DurationVar(&reportAfter, "report-after", 0, "list the commands still running this long after startup, leaving them alone")
+	flag.DurationVar(&warmup, "warmup", 0, "during this long after startup, abnormal exits do not stop the other commands")
+	flag.Var(readyToDie, "shutdown-ready-file", "NAME=PATH: during -grace, kill the named command as soon as it creates PATH, telling it finished cleaning up (repeatable)")
+	flag.StringVar(&shutdownWaitFile, "shutdown-wait-file", "", "once -grace expires, wait for this file to be removed before killing, for up to another -grace")
+	flag.StringVar(&printPids, "print-pids", "", "print a \"pid<TAB>name<TAB>command\" line for each launched command to stdout or stderr")
+	flag.BoolVar(&forceKill, "force-kill", false, "kill the children with SIGKILL right away on every shutdown, leaving them no chance to clean up")
+	flag.StringVar(&stopSignal, "stop-signal", "", "signal sent to all children on every shutdown, instead of SIGTERM or the signal multirun received")
+	flag.StringVar(&preStop, "pre-stop-signal", "", "signal sent to all children -pre-stop-delay before the stop signal, to let them drain")
+	flag.DurationVar(&preStopDelay, "pre-stop-delay", 5*time.Second, "delay between -pre-stop-signal and the stop signal")
+	flag.StringVar(&waitForAddr, "wait-for", "", "tcp://HOST:PORT to wait for, until a connection succeeds, before starting anything")
+	flag.StringVar(&waitForFile, "wait-for-file", "", "file to wait for before starting anything")
+	flag.Var(readyPatterns, "ready-pattern", "NAME=REGEX: start the commands following the named one only once it printed a line matching REGEX (repeatable)")
+	flag.DurationVar(&readyTimeout, "ready-timeout", time.Minute, "how long a command with -ready-pattern may take to print a matching line")
+	flag.DurationVar(&waitTimeout, "wait-timeout", time.Minute, "how long -wait-for and -wait-for-file wait before giving up")
+	flag.StringVar(&onReady, "on-ready", "", "shell command to run once all commands have started")
+	flag.StringVar(&onFailure, "on-failure", "", "shell command to run whenever a command exits abnormally, told which one through MULTIRUN_FAILED_* variables")
+	flag.DurationVar(&hookTimeout, "on-failure-timeout", 30*time.Second, "kill the -on-failure command if it runs for longer than this")
+	flag.StringVar(&readyFile, "ready-file", "", "file to create once all commands have started")
+	flag.IntVar(&restartGroup, "restart-group", 0, "when a command fails and the others were stopped, start them all again, up to N times")
+	flag.IntVar(&tailLines, "tail-lines", 0, "show the last N lines of stderr of each child that exits abnormally")
+	flag.StringVar(&tickSignal, "tick-signal", "", "signal to relay to all children every -tick-interval (e.g. SIGUSR1)")
+	flag.DurationVar(&tickInterval, "tick-interval", 0, "interval between two -tick-signal deliveries")
+	flag.StringVar(&stdin, "stdin", "", "name of the command that receives the stdin of multirun")
+	flag.StringVar(&envFile, "env-file", "", "file of KEY=VALUE lines added to the environment of the commands")
+	flag.StringVar(&syslogSpec, "syslog", "", "also send the output of the children to syslog, as FACILITY[.SEVERITY] (e.g. daemon)")
+	flag.StringVar(&showConfig, "show-config", "", "print the resolved configuration of every command, as text or json, before running them")
+	flag.StringVar(&report, "report", "", "file to write a JSON report of the outcome of every command to at exit")
+	flag.StringVar(&exitPolicy, "exit-code-policy", "", "on failure, exit with the code of the first, last or highest failure instead of 1")
+	flag.StringVar(&exitCodeDir, "exitcode-dir", "", "directory to write the exit code of each command to, in NAME.exitcode, when it exits")
+	flag.StringVar(&statusFile, "status-file", "", "file to write a JSON status of all commands to on -status-signal")
+	flag.StringVar(&statusSignal, "status-signal", "SIGUSR1", "signal that makes multirun write -status-file")
+	flag.StringVar(&controlSocket, "control-socket", "", "path of a unix socket accepting control commands")
+	flag.StringVar(&send, "send", "", "instead of running commands, send this control command to the multirun listening on -control-socket, print the reply and exit")
+	flag.Var(users, "user", "NAME=USER[:GROUP]: run the named command as this user and group (repeatable)")
+	flag.Var(niceness, "nice", "NAME=N: run the named command with niceness N, from -20 to 19 (repeatable)")
+	flag.Var(umasks, "umask", "NAME=MODE: run the named command with this octal umask, e.g. 027 (repeatable)")
+	flag.Var(rlimits, "rlimit", "NAME=RESOURCE:SOFT[:HARD][,...]: resource limits of the named command, e.g. nofile:1024,as:1G (repeatable)")
+	flag.StringVar(&leader, "leader", "", "name of the command whose exit always stops the others, in every mode, while the exits of the others never do")
+	flag.StringVar(&critical, "critical", "", "comma-separated names of the only commands whose exit stops the others")
+	flag.StringVar(&forking, "forking", "", "comma-separated names of the commands that daemonize, followed into the process they fork")
+	flag.Var(graces, "command-grace", "NAME=DURATION: -grace of the named command (repeatable)")
+	flag.Var(restartOn, "restart-on", "NAME=CODES: start the named command again when it exits with one of these codes, e.g. 75 or 64-78, instead of handling the exit (repeatable)")
+	flag.IntVar(&maxRestarts, "max-restarts", 0, "once a command was restarted this many times, -restart-on no longer starts it again (0 for unlimited)")
+	flag.Var(interpreters, "interpreter", "NAME=PROGRAM[:FLAG]: run the named command as code given to PROGRAM after FLAG, -c by default, instead of as a shell command (repeatable)")
+	flag.Var(delays, "restart-delay", "NAME=DURATION: wait this long before starting the named command again when it is restarted (repeatable)")
+	flag.Var(cpus, "cpus", "NAME=CPUS: run the named command on these CPUs only, e.g. 0-3,6 (repeatable)")
+	flag.Var(essential, "essential", "NAME=false: the exit of the named command does not stop the others (repeatable)")
+	flag.Var(signalMaps, "map-signal", "NAME=FROM:TO[,...]: send TO instead of FROM to the named command on shutdown and relays (repeatable)")
+	flag.Var(&watches, "watch", "PATH:NAME: restart the named command when PATH, a file or a directory tree, changes (repeatable)")
+	flag.Var(exitMeanings, "exit-meaning", "NAME=CODE:TEXT[,...]: describe exit codes of the named command in the final messages and the report (repeatable)")
+	flag.Var(stopPriority, "stop-priority", "NAME=N: stop the named command after all commands with a lower priority have exited (repeatable)")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s <options> command...\n", os.Args[0])
 		flag.PrintDefaults()
 	}
+	envFlags, err := setFlagsFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "multirun: %v\n", err)
+		os.Exit(exitUsage)
+	}
 	flag.Parse()
 
+	if send != "" {
+		if controlSocket == "" || flag.NArg() > 0 {
+			fmt.Fprintln(os.Stderr, "multirun: -send requires -control-socket and takes no command")
+			os.Exit(exitUsage)
+		}
+		os.Exit(sendControl(controlSocket, send))
+	}
+	if verbose && quiet {
+		fmt.Fprintln(os.Stderr, "multirun: -v and -quiet are mutually exclusive")
+		os.Exit(exitUsage)
+	}
+	if noSubreaper && requireSubreaper {
+		fmt.Fprintln(os.Stderr, "multirun: -no-subreaper and -require-subreaper are mutually exclusive")
+		os.Exit(exitUsage)
+	}
+	if forceKill && (grace > 0 || len(graces) > 0 || stopSignal != "" || preStop != "" || shutdownWaitFile != "" || len(readyToDie) > 0) {
+		fmt.Fprintln(os.Stderr, "multirun: -force-kill cannot be combined with options for a graceful shutdown: -grace, -command-grace, -stop-signal, -pre-stop-signal, -shutdown-wait-file and -shutdown-ready-file")
+		os.Exit(exitUsage)
+	}
+	if leader != "" && critical != "" {
+		fmt.Fprintln(os.Stderr, "multirun: -leader and -critical are mutually exclusive")
+		os.Exit(exitUsage)
+	}
+	if forking != "" && noSubreaper {
+		fmt.Fprintln(os.Stderr, "multirun: -forking requires the subreaper, it cannot be used with -no-subreaper")
+		os.Exit(exitUsage)
+	}
+	if systemdScope && useCgroup {
+		fmt.Fprintln(os.Stderr, "multirun: -systemd-scope and -cgroup are mutually exclusive")
+		os.Exit(exitUsage)
+	}
+	if systemdScope && len(users) > 0 {
+		fmt.Fprintln(os.Stderr, "multirun: -systemd-scope cannot be combined with -user")
+		os.Exit(exitUsage)
+	}
+	if tuiMode && (pty || stdin != "") {
+		fmt.Fprintln(os.Stderr, "multirun: -tui cannot be combined with -pty or -stdin, which also use the terminal")
+		os.Exit(exitUsage)
+	}
+	if pty && stdin != "" {
+		fmt.Fprintln(os.Stderr, "multirun: -pty and -stdin are mutually exclusive")
+		os.Exit(exitUsage)
+	}
+	if exitPolicy != "" && exitPolicy != "first" && exitPolicy != "last" && exitPolicy != "highest" {
+		fmt.Fprintf(os.Stderr, "multirun: -exit-code-policy must be first, last or highest, not %q\n", exitPolicy)
+		os.Exit(exitUsage)
+	}
+	if showConfig != "" && showConfig != "text" && showConfig != "json" {
+		fmt.Fprintf(os.Stderr, "multirun: -show-config must be text or json, not %q\n", showConfig)
+		os.Exit(exitUsage)
+	}
+	if restartGroup < 0 {
+		fmt.Fprintln(os.Stderr, "multirun: -restart-group cannot be negative")
+		os.Exit(exitUsage)
+	}
+	if shutdownWaitFile != "" && grace <= 0 && len(graces) == 0 {
+		fmt.Fprintln(os.Stderr, "multirun: -shutdown-wait-file requires -grace")
+		os.Exit(exitUsage)
+	}
+	if len(readyToDie) > 0 && grace <= 0 && len(graces) == 0 {
+		fmt.Fprintln(os.Stderr, "multirun: -shutdown-ready-file requires -grace")
+		os.Exit(exitUsage)
+	}
+
+	switch logTo {
+	case "stderr":
+		logOutput = os.Stderr
+	case "stdout":
+		logOutput = os.Stdout
+	default:
+		fmt.Fprintf(os.Stderr, "multirun: -log-output must be stderr or stdout, not %q\n", logTo)
+		os.Exit(exitUsage)
+	}
+
+	// The application instance exists from here on, so that every exit
+	// writes the -report.
+	app := newMultirun(verbose)
+	app.envFlags = envFlags
+
+	// After an upgrade, the previous image already changed directory, which
+	// a relative -chdir would now resolve from.
+	if chdir != "" && os.Getenv(handoffEnv) == "" {
+		if err := os.Chdir(chdir); err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -chdir: %v\n", err)
+			app.abort(exitStartup, report)
+		}
+		logf(verbose, "changed directory to %s", chdir)
+	}
+
 	// 2. Set subreaper status, now that we know the verbose setting.
-	setSubreaper(verbose)
+	if noSubreaper {
+		logf(verbose, "not registering as subreaper, as requested.")
+	} else if err := setSubreaper(); err == nil {
+		logf(verbose, "successfully registered as subreaper.")
+	} else if requireSubreaper {
+		fmt.Fprintf(os.Stderr, "multirun: failed to register as subreaper: %v\n", err)
+		app.abort(exitStartup, report)
+	} else {
+		logf(verbose, "failed to register as subreaper (%v), subchildren exit status might be ignored.", err)
+	}
 
-	// 3. Create the application instance.
-	app := &multirun{
-		verbose:      verbose,
-		subprocesses: make(map[int]*subprocess),
-		exitChan:     make(chan *subprocess, 1),
-		sigChan:      make(chan os.Signal, 1),
+	// 3. Configure the application instance.
+	app.quiet = quiet
+	app.initMode = initMode
+	app.keepGoing = keepGoing
+	app.grace = grace
+	app.warmup = warmup
+	app.reportAfter = reportAfter
+	app.heartbeat = heartbeat
+	app.waitFile = shutdownWaitFile
+	maps.Copy(app.readyToDie, readyToDie)
+	app.maxRate = maxRate
+	app.tailLines = tailLines
+	app.onReady = onReady
+	app.onFailure = onFailure
+	app.hookTimeout = hookTimeout
+	app.readyFile = readyFile
+	app.stdinTarget = stdin
+	app.pty = pty
+	app.trackOutput = trackOutput
+	app.timing = timing
+	if stdbuf {
+		if _, err := exec.LookPath("stdbuf"); err == nil {
+			app.stdbuf = true
+		} else {
+			fmt.Fprintln(os.Stderr, "multirun: -stdbuf: stdbuf is not installed, running the commands as is")
+		}
+	}
+	if systemdScope {
+		if systemdAvailable() {
+			app.systemdScope = true
+		} else {
+			fmt.Fprintln(os.Stderr, "multirun: -systemd-scope: systemd is not available, running the commands without scopes")
+		}
 	}
+	app.watches = watches
 
-	commands := flag.Args()
-	if len(commands) == 0 {
-		flag.Usage()
-		os.Exit(2)
+	if (tickSignal == "") != (tickInterval == 0) {
+		fmt.Fprintln(os.Stderr, "multirun: -tick-signal and -tick-interval must be used together")
+		os.Exit(exitUsage)
+	}
+	if tickSignal != "" {
+		sig, err := parseSignal(tickSignal)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -tick-signal: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		if tickInterval < 0 {
+			fmt.Fprintln(os.Stderr, "multirun: -tick-interval must be positive")
+			os.Exit(exitUsage)
+		}
+		app.tickSignal = sig
+		app.tickInterval = tickInterval
 	}
 
-	if err := app.startSubprocesses(commands); err != nil {
-		fmt.Fprintf(os.Stderr, "multirun: %v\n", err)
-		os.Exit(2)
+	if exitCodeDir != "" {
+		if info, err := os.Stat(exitCodeDir); err != nil || !info.IsDir() {
+			fmt.Fprintf(os.Stderr, "multirun: -exitcode-dir: %s is not a directory\n", exitCodeDir)
+			os.Exit(exitUsage)
+		}
+		app.exitCodeDir = exitCodeDir
 	}
 
-	if len(app.subprocesses) == 0 {
-		logf(app.verbose, "no processes were successfully started.")
-		os.Exit(1)
+	if statusFile != "" {
+		sig, err := parseSignal(statusSignal)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -status-signal: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		switch sig {
+		case syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2, syscall.SIGCHLD, syscall.SIGKILL, syscall.SIGSTOP:
+			fmt.Fprintf(os.Stderr, "multirun: -status-signal: %s cannot be used\n", sig)
+			os.Exit(exitUsage)
+		}
+		app.statusSignal = sig
+		app.statusFile = statusFile
 	}
 
-	hadErrors := app.handleEvents()
+	switch printPids {
+	case "":
+	case "stdout":
+		app.pidOutput = os.Stdout
+	case "stderr":
+		app.pidOutput = os.Stderr
+	default:
+		fmt.Fprintf(os.Stderr, "multirun: -print-pids must be stdout or stderr, not %q\n", printPids)
+		os.Exit(exitUsage)
+	}
 
-	if hadErrors {
-		fmt.Fprintln(os.Stderr, "multirun: one or more of the provided commands ended abnormally")
-		os.Exit(1)
+	if preStop != "" {
+		sig, err := parseSignal(preStop)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -pre-stop-signal: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		app.preStop = sig
+		app.preStopDelay = preStopDelay
 	}
 
-	logf(app.verbose, "all subprocesses exited without errors")
-	os.Exit(0)
-}
+	if stopSignal != "" {
+		sig, err := parseSignal(stopSignal)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -stop-signal: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		app.forcedStop = sig
+	}
+	// SIGKILL as the stop signal counts as a normal exit, as any stop
+	// signal does.
+	if forceKill {
+		app.forcedStop = syscall.SIGKILL
+	}
 
-// startSubprocesses launches all the commands as child processes.
-func (app *multirun) startSubprocesses(commands []string) error {
-	for _, command := range commands {
-		if isChained(command) {
-			return fmt.Errorf("error: chained commands are not supported. Please provide each command as a separate argument")
+	if stderrFile != "" {
+		f, err := os.OpenFile(stderrFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -stderr-file: %v\n", err)
+			app.abort(exitStartup, report)
 		}
+		app.stderr = f
+	}
 
-		cmd := exec.Command("sh", "-c", "exec "+command)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if grep != "" {
+		re, err := regexp.Compile(grep)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -grep: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		app.grep = re
+	}
 
-		proc := &subprocess{
-			cmd:     cmd,
-			command: command,
+	if prefixSpec != "" {
+		format, err := parsePrefixFormat(prefixSpec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -prefix-format: %v\n", err)
+			os.Exit(exitUsage)
 		}
+		app.prefix = format
+	}
 
-		if err := cmd.Start(); err != nil {
-			fmt.Fprintf(os.Stderr, "multirun: error starting command '%s': %v\n", command, err)
-			continue
+	if syslogSpec != "" {
+		stdout, stderr, err := parseSyslog(syslogSpec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -syslog: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		// Fail now rather than once for each child if there is no syslog.
+		probe, err := syslog.Dial("", "", stdout, "multirun")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -syslog: %v\n", err)
+			app.abort(exitStartup, report)
 		}
+		probe.Close()
+		app.useSyslog = true
+		app.syslogStdout, app.syslogStderr = stdout, stderr
+	}
 
-		pid := cmd.Process.Pid
-		proc.up = true
-		app.subprocesses[pid] = proc
-		logf(app.verbose, "launched command \"%s\" with pid %d", command, pid)
+	// The defaults are set by newMultirun.
+	if okCodes != "0" {
+		codes, err := parseExitCodes(okCodes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -ok-codes: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		app.okCodes = codes
+	}
+	if okSignals != "INT,TERM" {
+		app.okSignals = make(map[syscall.Signal]bool)
+		for _, name := range strings.Split(okSignals, ",") {
+			if name == "" {
+				continue
+			}
+			sig, err := parseSignal(name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "multirun: -ok-signals: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			app.okSignals[sig] = true
+		}
+	}
 
-		go func(p *subprocess) {
-			p.err = p.cmd.Wait()
-			app.exitChan <- p
-		}(proc)
+	for name, value := range stopPriority {
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -stop-priority: invalid priority %q for %s\n", value, name)
+			os.Exit(exitUsage)
+		}
+		app.stopPriority[name] = priority
 	}
-	return nil
-}
 
-// handleEvents is the main event loop. It waits for signals or process exits
-// and returns true if any process exited with an error.
-func (app *multirun) handleEvents() (hadErrors bool) {
-	signal.Notify(app.sigChan, syscall.SIGINT, syscall.SIGTERM)
+	for name, value := range niceness {
+		nice, err := strconv.Atoi(value)
+		if err != nil || nice < -20 || nice > 19 {
+			fmt.Fprintf(os.Stderr, "multirun: -nice: invalid niceness %q for %s, expected -20 to 19\n", value, name)
+			os.Exit(exitUsage)
+		}
+		app.niceness[name] = nice
+	}
 
-	runningProcesses := len(app.subprocesses)
-	closing := false
+	for name, value := range umasks {
+		umask, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || umask > 0o777 {
+			fmt.Fprintf(os.Stderr, "multirun: -umask: invalid umask %q for %s, expected an octal mode such as 027\n", value, name)
+			os.Exit(exitUsage)
+		}
+		app.umasks[name] = int(umask)
+	}
 
-	for runningProcesses > 0 {
-		select {
-		case proc := <-app.exitChan:
-			runningProcesses--
-			proc.up = false
+	for name, value := range graces {
+		grace, err := time.ParseDuration(value)
+		if err != nil || grace < 0 {
+			fmt.Fprintf(os.Stderr, "multirun: -command-grace: invalid duration %q for %s\n", value, name)
+			os.Exit(exitUsage)
+		}
+		app.graces[name] = grace
+	}
 
-			if !isNormalExit(proc.err) {
-				proc.err = fmt.Errorf("abnormal exit")
-				logf(app.verbose, "command \"%s\" with pid %d exited abnormally", proc.command, proc.cmd.Process.Pid)
-			} else {
-				proc.err = nil
-				logf(app.verbose, "command \"%s\" with pid %d exited normally", proc.command, proc.cmd.Process.Pid)
-			}
+	for name, value := range readyPatterns {
+		re, err := regexp.Compile(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -ready-pattern: invalid pattern for %s: %v\n", name, err)
+			os.Exit(exitUsage)
+		}
+		app.patterns[name] = re
+	}
+	app.readyTimeout = readyTimeout
 
-			if !closing {
-				closing = true
-				logf(app.verbose, "one process exited, sending SIGTERM to all other processes")
-				app.shutdown(syscall.SIGTERM)
-			}
+	for name, value := range restartOn {
+		codes, err := parseExitCodes(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -restart-on: %s: %v\n", name, err)
+			os.Exit(exitUsage)
+		}
+		app.restartCodes[name] = codes
+	}
+	if maxRestarts < 0 {
+		fmt.Fprintln(os.Stderr, "multirun: -max-restarts cannot be negative")
+		os.Exit(exitUsage)
+	}
+	app.maxRestarts = maxRestarts
 
-		case sig := <-app.sigChan:
-			if !closing {
-				closing = true
-				logf(app.verbose, "received signal %s, propagating to all subprocesses", sig)
-				app.shutdown(sig.(syscall.Signal))
-			}
+	for name, value := range interpreters {
+		program, option, _ := strings.Cut(value, ":")
+		if program == "" {
+			fmt.Fprintf(os.Stderr, "multirun: -interpreter: expected PROGRAM[:FLAG] for %s, got %q\n", name, value)
+			os.Exit(exitUsage)
+		}
+		if option == "" {
+			option = "-c"
 		}
+		app.interpreters[name] = interpreter{program: program, option: option}
 	}
 
-	for _, proc := range app.subprocesses {
-		if proc.err != nil {
-			return true
+	for name, value := range delays {
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay < 0 {
+			fmt.Fprintf(os.Stderr, "multirun: -restart-delay: invalid duration %q for %s\n", value, name)
+			os.Exit(exitUsage)
 		}
+		app.delays[name] = delay
 	}
-	return false
-}
 
-// shutdown sends the given signal to all running subprocesses.
-func (app *multirun) shutdown(signal syscall.Signal) {
-	for pid, proc := range app.subprocesses {
-		if proc.up {
-			if err := syscall.Kill(-pid, signal); err != nil {
-				if err != syscall.ESRCH {
-					fmt.Fprintf(os.Stderr, "multirun: error killing process group %d: %v\n", pid, err)
-				}
-			}
+	for name, spec := range cpus {
+		set, err := parseCPUList(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -cpus: %s: %v\n", name, err)
+			os.Exit(exitUsage)
 		}
+		app.cpus[name] = set
 	}
-}
 
-// isNormalExit checks if a process exit error is considered "normal".
-func isNormalExit(err error) bool {
-	if err == nil {
-		return true
+	for name, spec := range rlimits {
+		limits, err := parseRlimits(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -rlimit: %s: %v\n", name, err)
+			os.Exit(exitUsage)
+		}
+		app.rlimits[name] = limits
 	}
 
-	exitErr, ok := err.(*exec.ExitError)
-	if !ok {
-		return false
+	app.leader = leader
+	app.exitPolicy = exitPolicy
+	if critical != "" {
+		app.critical = make(map[string]bool)
+		for _, name := range strings.Split(critical, ",") {
+			app.critical[name] = true
+		}
 	}
 
-	ws, ok := exitErr.Sys().(syscall.WaitStatus)
-	if !ok {
-		return false
+	if forking != "" {
+		for _, name := range strings.Split(forking, ",") {
+			app.forking[name] = true
+		}
 	}
 
-	if ws.Exited() {
-		return ws.ExitStatus() == 0
+	for name, value := range essential {
+		isEssential, err := strconv.ParseBool(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -essential: invalid boolean %q for %s\n", value, name)
+			os.Exit(exitUsage)
+		}
+		app.essential[name] = isEssential
 	}
 
-	if ws.Signaled() {
-		sig := ws.Signal()
-		return sig == syscall.SIGINT || sig == syscall.SIGTERM
+	for name, spec := range signalMaps {
+		signals, err := parseSignalMap(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -map-signal: %s: %v\n", name, err)
+			os.Exit(exitUsage)
+		}
+		app.signalMaps[name] = signals
 	}
 
-	return false
-}
+	for name, spec := range exitMeanings {
+		meanings, err := parseExitMeanings(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -exit-meaning: %s: %v\n", name, err)
+			os.Exit(exitUsage)
+		}
+		app.exitMeanings[name] = meanings
+	}
 
-// isChained checks if a command string contains unquoted shell operators.
-func isChained(command string) bool {
-	var inQuote rune = 0
-	var escaped bool = false
-	for _, r := range command {
-		if escaped {
-			escaped = false
-			continue
+	var envVars []string
+	if envFile != "" {
+		vars, err := parseEnvFile(envFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -env-file: %v\n", err)
+			app.abort(exitStartup, report)
 		}
-		if r == '\\' {
-			escaped = true
-			continue
+		// exec.Cmd keeps the last value of duplicated keys, so the file
+		// overrides the inherited environment.
+		app.env = append(os.Environ(), vars...)
+		envVars = vars
+	}
+
+	for name, spec := range users {
+		cred, err := resolveCredential(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -user: %s: %v\n", name, err)
+			app.abort(exitStartup, report)
 		}
-		if inQuote != 0 {
-			if r == inQuote {
-				inQuote = 0
-			}
-		} else {
-			switch r {
-			case '\'', '"':
-				inQuote = r
-			case ';', '|', '&':
-				return true
+		app.credentials[name] = cred
+	}
+
+	commands := flag.Args()
+	if len(commands) == 0 {
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if script || (len(commands) == 1 && isMultirunScript(commands[0])) {
+		var read []string
+		for _, path := range commands {
+			lines, err := readScript(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "multirun: -script: %v\n", err)
+				app.abort(exitUsage, report)
 			}
+			read = append(read, lines...)
 		}
+		commands = read
 	}
-	return false
+
+	if template != "" {
+		expanded, err := expandTemplate(template, commands)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -template: %v\n", err)
+			app.abort(exitUsage, report)
+		}
+		commands = expanded
+	}
+
+	commands = dropBlankCommands(commands, verbose)
+	if dedupe {
+		commands = dedupeCommands(commands)
+	}
+	if len(commands) == 0 {
+		fmt.Fprintln(os.Stderr, "multirun: no commands to run once blank commands are dropped")
+		app.abort(exitNoCommands, report)
+	}
+	// An invalid command is reported before waiting for anything.
+	if err := app.checkCommands(commands); err != nil {
+		fmt.Fprintf(os.Stderr, "multirun: %v\n", err)
+		app.abort(exitUsage, report)
+	}
+
+	if showConfig != "" {
+		specs := map[string]perCommand{"user": users, "rlimit": rlimits, "cpus": cpus, "map-signal": signalMaps}
+		entries := app.resolveConfig(commands, envVars, specs)
+		if err := writeConfig(os.Stderr, entries, showConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -show-config: %v\n", err)
+			app.abort(exitStartup, report)
+		}
+	}
+
+	if waitForAddr != "" || waitForFile != "" {
+		if err := app.waitFor(waitForAddr, waitForFile, waitTimeout); err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: %v\n", err)
+			app.abort(exitStartup, report)
+		}
+	}
+
+	if controlSocket != "" {
+		if err := app.listenControl(controlSocket); err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: %v\n", err)
+			app.abort(exitStartup, report)
+		}
+	}
+
+	if useCgroup {
+		cg, err := createCgroup()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -cgroup: %v\n", err)
+			app.abort(exitStartup, report)
+		}
+		logf(verbose, "running the children in %s", cg.path)
+		app.cgroup = cg
+	}
+
+	if len(watches) > 0 {
+		w, err := newWatcher(watches)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: -watch: %v\n", err)
+			app.abort(exitStartup, report)
+		}
+		app.watcher = w
+		go w.run()
+	}
+
+	handoff := os.Getenv(handoffEnv)
+	if handoff != "" {
+		os.Unsetenv(handoffEnv)
+		err = app.adoptSubprocesses(commands, handoff)
+	} else {
+		if tuiMode {
+			if app.tui, err = app.startTUI(); err != nil {
+				fmt.Fprintf(os.Stderr, "multirun: -tui: %v, running without it\n", err)
+			}
+		}
+		err = app.startSubprocesses(commands)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "multirun: %v\n", err)
+		app.abort(exitUsage, report)
+	}
+
+	if len(app.subprocesses) == 0 {
+		fmt.Fprintln(os.Stderr, "multirun: no processes were successfully started")
+		app.abort(exitStartup, report)
+	}
+
+	// After an upgrade, the previous image already announced readiness.
+	// Behind a -ready-pattern, the event loop announces it once the last
+	// command started.
+	if handoff == "" && app.gate == nil {
+		if len(app.subprocesses) == len(commands) {
+			app.announceReady()
+		} else {
+			logf(app.verbose, "only %d of %d processes started", len(app.subprocesses), len(commands))
+		}
+	}
+
+	hadErrors := app.handleEvents(context.Background())
+	for attempt := 1; app.groupFailed && attempt <= restartGroup; attempt++ {
+		fmt.Fprintf(os.Stderr, "multirun: %s, starting all the commands again (%d of %d)\n", app.stopCause, attempt, restartGroup)
+		app.resetRun()
+		if err := app.startSubprocesses(commands); err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: %v\n", err)
+			break
+		}
+		if len(app.subprocesses) == 0 {
+			fmt.Fprintln(os.Stderr, "multirun: no processes were successfully started")
+			break
+		}
+		hadErrors = app.handleEvents(context.Background())
+	}
+	app.closeControl()
+	app.closeTUI()
+	app.closeCgroup()
+	app.reportFailures()
+	app.reportTimes()
+	app.writeReportFile(report)
+	// Failure notifications are not cut short, within their timeout.
+	app.hookWait.Wait()
+
+	if hadErrors {
+		fmt.Fprintf(os.Stderr, "multirun: one or more of the provided commands ended abnormally%s\n", app.outcome())
+		os.Exit(app.failureCode())
+	}
+
+	logf(app.verbose, "all subprocesses exited without errors%s", app.outcome())
+	os.Exit(exitSuccess)
+}
+
+// failureCode returns the exit code of multirun after a failure: 1, or with
+// -exit-code-policy, the exit code of the essential subprocess that failed
+// first, last, or with the highest code. A failure without an exit code, such
+// as an exit with 0 outside of -ok-codes, is left out.
+func (app *multirun) failureCode() int {
+	var chosen *subprocess
+	for _, proc := range app.subprocesses {
+		if proc.err == nil || proc.optional || proc.exitCode <= 0 {
+			continue
+		}
+		switch {
+		case chosen == nil,
+			app.exitPolicy == "first" && proc.exited.Before(chosen.exited),
+			app.exitPolicy == "last" && proc.exited.After(chosen.exited),
+			app.exitPolicy == "highest" && proc.exitCode > chosen.exitCode:
+			chosen = proc
+		}
+	}
+	if app.exitPolicy == "" || chosen == nil {
+		return exitChildFailure
+	}
+	return chosen.exitCode
+}
+
+// outcome describes how the run ended, to complete the final message: by
+// itself, by a cascade, on a signal or a stop request, and whether the
+// survivors had to be killed.
+func (app *multirun) outcome() string {
+	var parts []string
+	if app.stopCause != "" {
+		parts = append(parts, app.stopCause)
+	}
+	if app.killedAfter > 0 {
+		parts = append(parts, "survivors killed after the "+app.killedAfter.String()+" grace period")
+	}
+	if len(parts) == 0 {
+		return " (all exited on their own)"
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
+}
+
+// envFlagPrefix starts the environment variables that set options, such as
+// MULTIRUN_STOP_SIGNAL for -stop-signal.
+const envFlagPrefix = "MULTIRUN_"
+
+// setFlagsFromEnv sets the options given as environment variables, and
+// returns them as KEY=VALUE pairs. It runs before the command line is parsed,
+// which thus takes precedence. The variables are removed from the
+// environment, which the children and the hooks inherit: a multirun run as a
+// command would take them as its own options, and e.g. replace the
+// -control-socket of its parent.
+func setFlagsFromEnv() ([]string, error) {
+	var vars []string
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		name := f.Name
+		if name == "v" {
+			name = "verbose"
+		}
+		key := envFlagPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		// The variables multirun sets for itself and its children are not
+		// options, whatever options are added.
+		if key == handoffEnv || key == serviceEnv || strings.HasPrefix(key, failureEnvPrefix) {
+			return
+		}
+		value, ok := os.LookupEnv(key)
+		if !ok || err != nil {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("%s: invalid value %q: %v", key, value, setErr)
+		}
+		vars = append(vars, key+"="+value)
+		os.Unsetenv(key)
+	})
+	return vars, err
+}
+
+// resetRun forgets the subprocesses of a run and how it ended, before all the
+// commands are started again with -restart-group.
+func (app *multirun) resetRun() {
+	app.subprocesses = make(map[int]*subprocess)
+	app.gate = nil
+	app.startFailed = false
+	app.stopSignal = 0
+	app.stopCause = ""
+	app.groupFailed = false
+	app.killedAfter = 0
+}
+
+// startSubprocesses launches all the commands as child processes.
+func (app *multirun) startSubprocesses(commands []string) error {
+	// Validate everything before launching anything, so that an invalid
+	// command does not leave the previous ones running.
+	if err := app.checkCommands(commands); err != nil {
+		return err
+	}
+	app.pending, app.pendingNames = commands, commandNames(commands)
+	app.startPending()
+	return nil
+}
+
+// checkCommands checks that the commands can run: that the per-command
+// options name existing commands, and that each command is quoted properly
+// and not chained. The code of an -interpreter is not for the shell.
+func (app *multirun) checkCommands(commands []string) error {
+	names := commandNames(commands)
+	if err := app.checkCommandNames(names); err != nil {
+		return err
+	}
+	for i, command := range commands {
+		if _, ok := app.interpreters[names[i]]; ok {
+			continue
+		}
+		if err := checkQuoting(command); err != nil {
+			return fmt.Errorf("error: invalid command %q: %v", command, err)
+		}
+		if isChained(command) {
+			return fmt.Errorf("error: chained commands are not supported. Please provide each command as a separate argument")
+		}
+	}
+	return nil
+}
+
+// startPending launches the pending commands in order, up to the first one
+// with a -ready-pattern that is followed by others, which becomes the gate:
+// the commands after it are started once it is ready. It returns how many
+// commands were launched.
+func (app *multirun) startPending() int {
+	app.gate = nil
+	launched := 0
+	for len(app.pending) > 0 {
+		command, name := app.pending[0], app.pendingNames[0]
+		app.pending, app.pendingNames = app.pending[1:], app.pendingNames[1:]
+		proc := app.launch(command, name)
+		if proc == nil {
+			app.startFailed = true
+			continue
+		}
+		launched++
+		if proc.ready != nil && len(app.pending) > 0 {
+			logf(app.verbose, "waiting for %s to print a line matching %q", name, app.patterns[name])
+			app.gate = proc
+			break
+		}
+	}
+	return launched
+}
+
+// launch starts a command as the subprocess called name. Errors are reported
+// and leave the command out, launch then returns nil.
+func (app *multirun) launch(command, name string) *subprocess {
+	proc := &subprocess{
+		command:   command,
+		name:      name,
+		priority:  app.stopPriority[name],
+		optional:  !app.isEssential(name),
+		signalMap: app.signalMaps[name],
+		meanings:  app.exitMeanings[name],
+		grace:     app.graceOf(name),
+		forking:   app.forking[name],
+	}
+	if app.patterns[name] != nil {
+		proc.ready = make(chan struct{})
+	}
+	// Leaving the streams unset connects them to /dev/null.
+	if app.tailLines > 0 {
+		proc.tail = &tailBuffer{size: app.tailLines}
+	}
+	attr := &syscall.SysProcAttr{
+		Setpgid:    true,
+		Credential: app.credentials[name],
+	}
+	// Starting the child right in the cgroup leaves no window in which
+	// it could fork outside of it.
+	if app.cgroup != nil {
+		attr.UseCgroupFD = true
+		attr.CgroupFD = app.cgroup.fd
+	}
+	// The stdin of multirun is copied through a pipe rather than handed
+	// over, as the child is not in the foreground process group of the
+	// terminal and could not read from it.
+	var stdin io.Reader
+	var stdinRead, stdinWrite *os.File
+	if proc.name == app.stdinTarget {
+		var err error
+		if stdinRead, stdinWrite, err = os.Pipe(); err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: error creating stdin pipe for '%s': %v\n", command, err)
+			return nil
+		}
+		stdin = stdinRead
+	}
+	var stdout, stderr, ptyOutput io.Writer
+	var ptyMaster, ptySlave *os.File
+	if app.pty {
+		var err error
+		if ptyMaster, ptySlave, err = openPty(); err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: error allocating a pty for '%s': %v\n", command, err)
+			return nil
+		}
+		// The child leads a new session, and thus process group, with
+		// the pty as its controlling terminal.
+		attr.Setpgid = false
+		attr.Setsid = true
+		attr.Setctty = true
+		stdin, stdout, stderr = ptySlave, ptySlave, ptySlave
+		ptyOutput = app.outputWriter(proc, os.Stdout, proc.tail, app.syslogStdout)
+	} else {
+		stdout = app.outputWriter(proc, os.Stdout, nil, app.syslogStdout)
+		stderr = app.outputWriter(proc, app.stderr, proc.tail, app.syslogStderr)
+	}
+	// The daemon of a -forking command is told apart from other
+	// orphans by a variable it inherits.
+	env := app.env
+	if proc.forking {
+		if env == nil {
+			env = os.Environ()
+		}
+		env = append(env[:len(env):len(env)], serviceEnv+"="+proc.name)
+	}
+	// A marker left by a previous run would get the command killed as
+	// soon as a shutdown starts.
+	if path, ok := app.readyToDie[name]; ok {
+		os.Remove(path)
+	}
+	proc.process = app.newProcess(app.shellScript(name, command), attr, env, stdin, stdout, stderr)
+
+	err := proc.process.Start()
+	if stdinRead != nil {
+		stdinRead.Close()
+	}
+	if ptySlave != nil {
+		ptySlave.Close()
+	}
+	if err != nil {
+		// sh is the only program looked up in PATH: the commands are
+		// found by the shell, which reports them missing itself.
+		if errors.Is(err, exec.ErrNotFound) {
+			fmt.Fprintf(os.Stderr, "multirun: error starting command '%s': sh was not found in PATH. multirun runs every command through sh -c, even with -interpreter, so the image needs a shell such as busybox\n", command)
+		} else {
+			fmt.Fprintf(os.Stderr, "multirun: error starting command '%s': %v\n", command, err)
+		}
+		if stdinWrite != nil {
+			stdinWrite.Close()
+		}
+		if ptyMaster != nil {
+			ptyMaster.Close()
+		}
+		return nil
+	}
+	if stdinWrite != nil {
+		go app.forwardStdin(proc, stdinWrite)
+	}
+	if ptyMaster != nil {
+		proc.ptyDone = make(chan struct{})
+		proc.ptyMaster = ptyMaster
+		go copyPty(proc, ptyMaster, ptyOutput)
+	}
+
+	pid := proc.process.Pid()
+	proc.up = true
+	proc.started = app.clock.Now()
+	app.subprocesses[pid] = proc
+	logf(app.verbose, "launched command \"%s\" as %s with pid %d", command, proc.name, pid)
+	if app.pidOutput != nil {
+		fmt.Fprintf(app.pidOutput, "%d\t%s\t%s\n", pid, proc.name, command)
+	}
+
+	// The affinity is set after the start, so it only reaches what the child
+	// forks from now on.
+	if set, ok := app.cpus[proc.name]; ok {
+		if err := schedAffinity(syscall.SYS_SCHED_SETAFFINITY, pid, set); err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: error setting the CPU affinity of %s: %v\n", proc.name, err)
+		}
+	}
+
+	go app.waitSubprocess(proc)
+	return proc
+}
+
+// forwardStdin copies the stdin of multirun to w, the stdin of the
+// subprocess, and closes w at end of file so that the subprocess sees the end
+// of its input too. multirun itself keeps running.
+func (app *multirun) forwardStdin(p *subprocess, w *os.File) {
+	defer w.Close()
+	if _, err := io.Copy(w, os.Stdin); err != nil {
+		// The subprocess is gone or stopped reading its input.
+		logf(app.verbose, "stopped forwarding stdin to %s: %v", p.name, err)
+		return
+	}
+	logf(app.verbose, "end of stdin, closing the stdin of %s", p.name)
+}
+
+// copyPty copies the output of a child from the master end of its pty to w,
+// or discards it if w is nil. Reading fails with EIO once every process that
+// had the pty open exited.
+func copyPty(p *subprocess, master *os.File, w io.Writer) {
+	defer close(p.ptyDone)
+	defer master.Close()
+	if w == nil {
+		w = io.Discard
+	}
+	io.Copy(w, master)
+}
+
+// waitSubprocess waits for a subprocess to exit and reports it to the event
+// loop.
+func (app *multirun) waitSubprocess(p *subprocess) {
+	p.err = p.process.Wait()
+	// Like the pipes, the pty is read for at most outputWaitDelay once the
+	// child exited, whatever descendants still hold it open. Closing the
+	// master ends the copy.
+	if p.ptyDone != nil {
+		select {
+		case <-p.ptyDone:
+		case <-app.clock.After(outputWaitDelay):
+			p.ptyMaster.Close()
+			<-p.ptyDone
+		}
+	}
+	p.flushOutput()
+	p.recordUsage()
+	app.exitChan <- p
+}
+
+// announceReady signals that every command has been started: it logs it,
+// creates the -ready-file and runs the -on-ready hook.
+func (app *multirun) announceReady() {
+	logf(app.verbose, "all %d processes ready", len(app.subprocesses))
+	if app.readyFile != "" {
+		if err := os.WriteFile(app.readyFile, nil, 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: error creating ready file: %v\n", err)
+		}
+	}
+	if app.onReady != "" {
+		app.runHook("on-ready", app.onReady, nil, 0)
+	}
+}
+
+// runHook runs a shell command in the background, outside of supervision:
+// its exit never affects the children. env is added to the environment of
+// multirun. A hook given a timeout is killed, with its process group, once
+// it expires, and multirun waits for it before exiting.
+func (app *multirun) runHook(name, command string, env []string, timeout time.Duration) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	if timeout > 0 {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+	// The lock keeps reapOrphans from seeing the hook before it is recorded.
+	app.hooksMu.Lock()
+	err := cmd.Start()
+	if err == nil {
+		app.hooks[cmd.Process.Pid] = timeout > 0
+	}
+	app.hooksMu.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "multirun: error starting %s hook: %v\n", name, err)
+		return
+	}
+	logf(app.verbose, "started %s hook with pid %d", name, cmd.Process.Pid)
+	var kill timer
+	if timeout > 0 {
+		app.hookWait.Add(1)
+		pid := cmd.Process.Pid
+		kill = app.clock.AfterFunc(timeout, func() {
+			fmt.Fprintf(os.Stderr, "multirun: %s hook still running after %s, killing it\n", name, timeout)
+			syscall.Kill(-pid, syscall.SIGKILL)
+		})
+	}
+	go func() {
+		err := cmd.Wait()
+		if kill != nil {
+			kill.Stop()
+			defer app.hookWait.Done()
+		}
+		app.hooksMu.Lock()
+		delete(app.hooks, cmd.Process.Pid)
+		app.hooksMu.Unlock()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: %s hook failed: %v\n", name, err)
+		}
+	}()
+}
+
+// isHook reports whether pid is a hook started by runHook.
+func (app *multirun) isHook(pid int) bool {
+	app.hooksMu.Lock()
+	defer app.hooksMu.Unlock()
+	_, ok := app.hooks[pid]
+	return ok
+}
+
+// isBoundedHook reports whether pgid is the process group of a hook with a
+// timeout. Such hooks are left to finish during a shutdown.
+func (app *multirun) isBoundedHook(pgid int) bool {
+	app.hooksMu.Lock()
+	defer app.hooksMu.Unlock()
+	return app.hooks[pgid]
+}
+
+// handoffEnv is the environment variable through which a multirun image
+// tells the next one, after an upgrade, which children it is running.
+const handoffEnv = "MULTIRUN_HANDOFF"
+
+// upgrade replaces the running image with the binary currently installed at
+// the path multirun was started from, keeping the same arguments. Children
+// are inherited by the new image, which adopts them instead of starting the
+// commands again. It only returns if the upgrade could not happen.
+func (app *multirun) upgrade() error {
+	// Piped output would be lost: the read ends of the pipes do not survive
+	// the exec.
+	if app.pipesOutput() {
+		return fmt.Errorf("child output goes through multirun and would be lost")
+	}
+	if app.tui != nil {
+		return fmt.Errorf("the output goes to the -tui, which would be lost")
+	}
+	if app.gate != nil {
+		return fmt.Errorf("commands are waiting for %s to be ready", app.gate.name)
+	}
+	if app.stdinTarget != "" {
+		return fmt.Errorf("the stdin of %s goes through multirun and would be closed", app.stdinTarget)
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// When the binary was replaced, the kernel reports the old one as deleted.
+	path = strings.TrimSuffix(path, " (deleted)")
+
+	var pairs []string
+	for _, pid := range app.sortedPids() {
+		if proc := app.subprocesses[pid]; proc.up {
+			pairs = append(pairs, fmt.Sprintf("%s=%d", proc.name, pid))
+		}
+	}
+	env := append(os.Environ(), app.envFlags...)
+	env = append(env, handoffEnv+"="+strings.Join(pairs, ","))
+	logf(app.verbose, "upgrading to %s", path)
+	return syscall.Exec(path, os.Args, env)
+}
+
+// adoptSubprocesses takes over the children handed off by a previous image,
+// described as comma-separated NAME=PID pairs, in place of starting them.
+func (app *multirun) adoptSubprocesses(commands []string, handoff string) error {
+	names := commandNames(commands)
+	if err := app.checkCommandNames(names); err != nil {
+		return err
+	}
+	pids := make(map[string]int)
+	for _, pair := range strings.Split(handoff, ",") {
+		name, value, _ := strings.Cut(pair, "=")
+		pid, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s entry %q", handoffEnv, pair)
+		}
+		pids[name] = pid
+	}
+
+	for i, command := range commands {
+		pid, ok := pids[names[i]]
+		if !ok {
+			continue
+		}
+		// The run time counts from the start of the child, not from the
+		// upgrade.
+		started := app.clock.Now()
+		if age, err := processAge(pid); err == nil {
+			started = started.Add(-age)
+		} else {
+			logf(app.verbose, "error reading the start time of pid %d: %v", pid, err)
+		}
+		proc := &subprocess{
+			process:   adoptExecProcess(command, pid),
+			command:   command,
+			name:      names[i],
+			priority:  app.stopPriority[names[i]],
+			optional:  !app.isEssential(names[i]),
+			signalMap: app.signalMaps[names[i]],
+			meanings:  app.exitMeanings[names[i]],
+			grace:     app.graceOf(names[i]),
+			forking:   app.forking[names[i]],
+			up:        true,
+			started:   started,
+		}
+		app.subprocesses[pid] = proc
+		logf(app.verbose, "adopted command \"%s\" as %s with pid %d", command, proc.name, pid)
+		go app.waitSubprocess(proc)
+	}
+	return nil
+}
+
+// handleEvents is the main event loop. It waits for signals or process exits
+// and returns true if any process exited with an error. Canceling ctx stops
+// all the subprocesses, as SIGTERM does.
+func (app *multirun) handleEvents(ctx context.Context) (hadErrors bool) {
+	signal.Notify(app.sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	if app.statusFile != "" {
+		signal.Notify(app.sigChan, app.statusSignal)
+	}
+	defer signal.Stop(app.sigChan)
+
+	// In init mode, SIGCHLD tells when an orphan adopted as subreaper may
+	// need reaping.
+	var sigChld chan os.Signal
+	if app.initMode {
+		sigChld = make(chan os.Signal, 1)
+		signal.Notify(sigChld, syscall.SIGCHLD)
+		defer signal.Stop(sigChld)
+	}
+
+	// With -pty, SIGWINCH tells when the terminal of multirun was resized.
+	var sigWinch chan os.Signal
+	if app.pty {
+		sigWinch = make(chan os.Signal, 1)
+		signal.Notify(sigWinch, syscall.SIGWINCH)
+		defer signal.Stop(sigWinch)
+	}
+
+	// Job control: suspending multirun, e.g. with Ctrl-Z, suspends the
+	// children, which are not in the foreground process group, and resuming
+	// it resumes them.
+	jobControl := make(chan os.Signal, 1)
+	signal.Notify(jobControl, syscall.SIGTSTP, syscall.SIGCONT)
+	defer signal.Stop(jobControl)
+
+	// A nil channel blocks forever, which keeps the tick case disabled
+	// unless -tick-interval was given.
+	var tick <-chan time.Time
+	if app.tickInterval > 0 {
+		var stop func()
+		tick, stop = app.clock.NewTicker(app.tickInterval)
+		defer stop()
+	}
+
+	// Changes to the -watch paths are debounced: the commands are only
+	// restarted once no change happened for watchDebounce.
+	var watchChanges <-chan string
+	if app.watcher != nil {
+		watchChanges = app.watcher.changes
+	}
+	changed := make(map[string]bool)
+	var debounce <-chan time.Time
+
+	var heartbeat <-chan time.Time
+	if app.heartbeat > 0 {
+		var stop func()
+		heartbeat, stop = app.clock.NewTicker(app.heartbeat)
+		defer stop()
+	}
+
+	var overrun <-chan time.Time
+	if app.reportAfter > 0 {
+		overrun = app.clock.After(app.reportAfter)
+	}
+
+	runningProcesses := len(app.subprocesses)
+	closing := false
+	warmupEnd := app.clock.Now().Add(app.warmup)
+
+	// stopAll starts the shutdown, preceded by the pre-stop signal if any.
+	// Once the stop signal is sent, with grace periods, stop arms the timer
+	// after which the first survivor is killed. With -stop-signal, sig is replaced whatever triggered the
+	// shutdown. cause tells what triggered it, for the final message.
+	var killTimer, preStopTimer <-chan time.Time
+	var stopStart time.Time
+	armKill := func(next time.Time) {
+		killTimer = nil
+		if !next.IsZero() {
+			killTimer = app.clock.After(next.Sub(app.clock.Now()))
+		}
+	}
+	// With -restart-delay, a command stopped to be restarted is launched
+	// again once its delay has passed, and counts as running meanwhile.
+	delayed := make(chan *subprocess)
+	pendingRestarts := make(map[*subprocess]timer)
+
+	// With -ready-pattern, the commands following the gate are started
+	// once it printed a matching line. Everything stops if it does not
+	// within -ready-timeout, or exits before.
+	var gateReady <-chan struct{}
+	var gateTimeout <-chan time.Time
+	armGate := func() {
+		gateReady, gateTimeout = nil, nil
+		if app.gate != nil {
+			gateReady = app.gate.ready
+			gateTimeout = app.clock.After(app.readyTimeout)
+		}
+	}
+	armGate()
+	notReady := false
+
+	// dropRestarts cancels the pending restarts and starts, when multirun
+	// stops or drains. A timer that fired already is handled in the delayed
+	// case.
+	dropRestarts := func() {
+		gateReady, gateTimeout = nil, nil
+		for proc, timer := range pendingRestarts {
+			if timer.Stop() {
+				delete(pendingRestarts, proc)
+				runningProcesses--
+				proc.answerRestart(fmt.Sprintf("error: %s was not restarted, multirun is shutting down\n", proc.name))
+			}
+		}
+	}
+
+	// Once draining on request of the control socket, nothing is restarted
+	// or stopped anymore: the commands run until they exit by themselves.
+	draining := false
+
+	var pendingStop syscall.Signal
+	stop := func(sig syscall.Signal) {
+		app.shutdown(sig)
+		stopStart = app.clock.Now()
+		armKill(app.killSurvivors(stopStart))
+	}
+	stopAll := func(sig syscall.Signal, cause string) {
+		closing = true
+		heartbeat = nil
+		dropRestarts()
+		app.stopCause = cause
+		if app.forcedStop != 0 && app.forcedStop != sig {
+			logf(app.verbose, "stopping with %s instead of %s", app.forcedStop, sig)
+			sig = app.forcedStop
+		}
+		if app.preStop != 0 {
+			logf(app.verbose, "sending pre-stop signal %s, stopping in %s", app.preStop, app.preStopDelay)
+			app.relay(app.preStop)
+			pendingStop = sig
+			preStopTimer = app.clock.After(app.preStopDelay)
+		} else {
+			stop(sig)
+		}
+	}
+
+	// In init mode, only a signal or a stop request ends the loop, even when
+	// every child is gone.
+	for runningProcesses > 0 || (app.initMode && !closing && !draining) {
+		select {
+		case proc := <-app.exitChan:
+			if proc.forking && proc.err == nil && !closing && app.followDaemon(proc) {
+				continue
+			}
+			runningProcesses--
+			proc.up = false
+			proc.exited = app.clock.Now()
+			proc.exitCode, proc.exitSignal = exitStatus(proc.err)
+			if app.exitCodeDir != "" {
+				if err := app.writeExitCode(proc); err != nil {
+					fmt.Fprintf(os.Stderr, "multirun: -exitcode-dir: %v\n", err)
+				}
+			}
+			// The kernel picks SIGKILL for the processes it kills when out
+			// of memory.
+			if proc.exitSignal == syscall.SIGKILL && !proc.killSent {
+				proc.possibleOOM = true
+				fmt.Fprintf(os.Stderr, "multirun: %s was killed by a SIGKILL multirun did not send, possibly by the OOM killer\n", proc.name)
+			}
+
+			// Being killed by the -stop-signal is as normal as by SIGTERM.
+			normal := app.isNormalExit(proc.err) || (app.forcedStop != 0 && proc.exitSignal == app.forcedStop)
+			if !normal {
+				proc.err = fmt.Errorf("abnormal exit")
+				logf(app.verbose, "command \"%s\" with pid %d exited abnormally (%s)", proc.command, proc.process.Pid(), proc.usage())
+				if app.onFailure != "" {
+					app.runHook("on-failure", app.onFailure, proc.failureEnv(), app.hookTimeout)
+				}
+			} else {
+				proc.err = nil
+				logf(app.verbose, "command \"%s\" with pid %d exited normally (%s)", proc.command, proc.process.Pid(), proc.usage())
+			}
+			if app.timing {
+				fmt.Fprintf(os.Stderr, "multirun: %s exited with %s after %s\n", proc.name, proc.exitDescription(), proc.runTime())
+			}
+
+			// An exit with one of the -restart-on codes is handled as a
+			// restart.
+			if !proc.restart && !closing && !draining && app.restartCodes[proc.name][proc.exitCode] {
+				if app.maxRestarts > 0 && proc.restarts >= app.maxRestarts {
+					fmt.Fprintf(os.Stderr, "multirun: %s exited with %s, not restarting it after %d restarts\n", proc.name, proc.exitDescription(), proc.restarts)
+				} else {
+					fmt.Fprintf(os.Stderr, "multirun: %s exited with %s, restarting it\n", proc.name, proc.exitDescription())
+					proc.restart = true
+				}
+			}
+
+			if proc.restart && !closing && !draining && app.delays[proc.name] > 0 {
+				logf(app.verbose, "starting %s again in %s", proc.name, app.delays[proc.name])
+				runningProcesses++
+				pendingRestarts[proc] = app.clock.AfterFunc(app.delays[proc.name], func() { delayed <- proc })
+				continue
+			} else if proc.restart && !closing && !draining {
+				if app.relaunch(proc) != nil {
+					runningProcesses++
+					continue
+				}
+			} else if proc.restart {
+				proc.answerRestart(fmt.Sprintf("error: %s was not restarted, multirun is shutting down\n", proc.name))
+			}
+
+			if proc == app.gate && !closing && !draining {
+				select {
+				case <-proc.ready:
+				default:
+					fmt.Fprintf(os.Stderr, "multirun: %s exited before printing a line matching %q\n", proc.name, app.patterns[proc.name])
+					notReady = true
+					stopAll(syscall.SIGTERM, fmt.Sprintf("stopped after %s exited before it was ready", proc.name))
+				}
+			}
+
+			// The exit of the -leader stops the others in every mode.
+			leader := proc.name == app.leader
+			if draining && !closing {
+				logf(app.verbose, "draining, not stopping the other processes")
+			} else if app.initMode && !closing && !leader {
+				logf(app.verbose, "init mode, not stopping the other processes")
+			} else if proc.optional && !closing {
+				logf(app.verbose, "%s is not essential, not stopping the other processes", proc.name)
+			} else if app.keepGoing && !closing && !leader {
+				logf(app.verbose, "keep going, not stopping the other processes")
+			} else if !normal && !closing && !leader && app.clock.Now().Before(warmupEnd) {
+				logf(app.verbose, "%s failed during the warm-up, not stopping the other processes", proc.name)
+			} else if !closing {
+				logf(app.verbose, "one process exited, sending SIGTERM to all other processes")
+				if normal {
+					stopAll(syscall.SIGTERM, fmt.Sprintf("stopped after %s exited", proc.name))
+				} else {
+					app.groupFailed = true
+					cause := fmt.Sprintf("stopped after %s failed", proc.name)
+					if meaning := proc.meanings[proc.exitCode]; meaning != "" {
+						cause += " with " + proc.exitDescription()
+					}
+					stopAll(syscall.SIGTERM, cause)
+				}
+			} else {
+				app.advanceShutdown()
+			}
+
+		case sig := <-app.sigChan:
+			if app.statusFile != "" && sig == app.statusSignal {
+				if err := app.writeStatusFile(); err != nil {
+					fmt.Fprintf(os.Stderr, "multirun: error writing status file: %v\n", err)
+				}
+				continue
+			}
+			if sig == syscall.SIGUSR2 {
+				if closing {
+					logf(app.verbose, "ignoring upgrade request during shutdown")
+				} else if err := app.upgrade(); err != nil {
+					fmt.Fprintf(os.Stderr, "multirun: upgrade failed: %v\n", err)
+				}
+				continue
+			}
+			if !closing {
+				logf(app.verbose, "received signal %s, propagating to all subprocesses", sig)
+				stopAll(sig.(syscall.Signal), fmt.Sprintf("stopped on %s", signalName(sig.(syscall.Signal))))
+			}
+
+		case <-sigChld:
+			app.reapOrphans()
+
+		case <-sigWinch:
+			app.resizePtys()
+
+		case sig := <-jobControl:
+			// multirun only stops once the children were told to, so
+			// that it keeps control until then.
+			logf(app.verbose, "relaying %s to all subprocesses", sig)
+			app.relay(sig.(syscall.Signal))
+			if sig == syscall.SIGTSTP {
+				syscall.Kill(os.Getpid(), syscall.SIGSTOP)
+			}
+
+		case name := <-watchChanges:
+			if !closing {
+				changed[name] = true
+				debounce = app.clock.After(watchDebounce)
+			}
+
+		case <-debounce:
+			for _, name := range slices.Sorted(maps.Keys(changed)) {
+				if !closing && !draining && app.restartCommand(name, nil) {
+					runningProcesses++
+				}
+			}
+			clear(changed)
+
+		case proc := <-delayed:
+			delete(pendingRestarts, proc)
+			if closing || draining {
+				runningProcesses--
+				proc.answerRestart(fmt.Sprintf("error: %s was not restarted, multirun is shutting down\n", proc.name))
+			} else if app.relaunch(proc) == nil {
+				runningProcesses--
+				if !app.initMode && !proc.optional && !app.keepGoing {
+					stopAll(syscall.SIGTERM, fmt.Sprintf("stopped after %s could not be started again", proc.name))
+				}
+			}
+
+		case req := <-app.controlChan:
+			if !req.quiet {
+				logf(app.verbose, "control command: %s", strings.Join(req.args, " "))
+			}
+			// A restart is only answered once the command runs again.
+			if req.args[0] == "restart" && len(req.args) == 2 {
+				if closing {
+					req.reply <- "error: multirun is shutting down\n"
+				} else if draining {
+					req.reply <- "error: multirun is draining\n"
+				} else if app.restartCommand(req.args[1], req.reply) {
+					runningProcesses++
+				}
+				continue
+			}
+			if req.args[0] == "drain" && len(req.args) == 1 {
+				if !draining && !closing {
+					logf(app.verbose, "draining: the commands are no longer restarted or stopped, multirun exits once they are all gone")
+					draining = true
+					dropRestarts()
+				}
+				req.reply <- "ok\n"
+				continue
+			}
+			reply, stop := app.handleControl(req.args)
+			req.reply <- reply
+			if stop && !closing {
+				logf(app.verbose, "stop requested on the control socket, sending SIGTERM to all processes")
+				stopAll(syscall.SIGTERM, "stopped on request on the control socket")
+			}
+
+		case <-ctx.Done():
+			if !closing {
+				logf(app.verbose, "%v, sending SIGTERM to all processes", context.Cause(ctx))
+				stopAll(syscall.SIGTERM, fmt.Sprintf("stopped on %v", context.Cause(ctx)))
+			}
+
+		case <-preStopTimer:
+			stop(pendingStop)
+
+		case <-killTimer:
+			armKill(app.killSurvivors(stopStart))
+
+		case <-gateReady:
+			logf(app.verbose, "%s is ready, starting the next commands", app.gate.name)
+			runningProcesses += app.startPending()
+			armGate()
+			if app.gate == nil {
+				if app.startFailed {
+					logf(app.verbose, "only %d processes started", len(app.subprocesses))
+				} else {
+					app.announceReady()
+				}
+			}
+
+		case <-gateTimeout:
+			fmt.Fprintf(os.Stderr, "multirun: %s did not print a line matching %q within %s\n", app.gate.name, app.patterns[app.gate.name], app.readyTimeout)
+			notReady = true
+			stopAll(syscall.SIGTERM, fmt.Sprintf("stopped after %s did not become ready", app.gate.name))
+
+		case <-overrun:
+			app.reportRunning()
+
+		case <-heartbeat:
+			app.logHeartbeat()
+
+		case <-tick:
+			// Children that are already being stopped are left alone.
+			if !closing {
+				logf(app.verbose, "relaying scheduled signal %s to all subprocesses", app.tickSignal)
+				app.relay(app.tickSignal)
+			}
+		}
+	}
+
+	if notReady {
+		return true
+	}
+	// Failures of optional subprocesses are logged but do not make the whole
+	// run fail.
+	for _, proc := range app.subprocesses {
+		if proc.err != nil && !proc.optional {
+			return true
+		}
+	}
+	return false
+}
+
+// logHeartbeat logs, even outside of verbose mode, how many subprocesses are
+// up and for how long, as proof that multirun is alive.
+func (app *multirun) logHeartbeat() {
+	var up []string
+	for _, pid := range app.sortedPids() {
+		if proc := app.subprocesses[pid]; proc.up {
+			up = append(up, fmt.Sprintf("%s (up %s)", proc.name, app.clock.Now().Sub(proc.started).Round(time.Second)))
+		}
+	}
+	logf(true, "heartbeat: %d of %d processes up: %s", len(up), len(app.subprocesses), strings.Join(up, ", "))
+}
+
+// reportRunning lists the subprocesses still running once -report-after
+// expired.
+func (app *multirun) reportRunning() {
+	var running []string
+	for _, pid := range app.sortedPids() {
+		if proc := app.subprocesses[pid]; proc.up {
+			running = append(running, fmt.Sprintf("%s (pid %d)", proc.name, pid))
+		}
+	}
+	if len(running) > 0 {
+		fmt.Fprintf(os.Stderr, "multirun: %d of %d commands still running after %s: %s\n", len(running), len(app.subprocesses), app.reportAfter, strings.Join(running, ", "))
+	}
+}
+
+// reportFailures prints the last lines of stderr recorded for each
+// subprocess that exited abnormally and, with -keep-going, the list of those
+// subprocesses.
+func (app *multirun) reportFailures() {
+	if app.keepGoing {
+		var failures []string
+		for _, pid := range app.sortedPids() {
+			proc := app.subprocesses[pid]
+			if proc.err != nil && !proc.optional {
+				failures = append(failures, fmt.Sprintf("%s (%s)", proc.name, proc.exitDescription()))
+			}
+		}
+		if len(failures) > 0 {
+			fmt.Fprintf(os.Stderr, "multirun: %d of %d commands failed: %s\n", len(failures), len(app.subprocesses), strings.Join(failures, ", "))
+		}
+	}
+	for _, pid := range app.sortedPids() {
+		proc := app.subprocesses[pid]
+		if proc.err == nil || proc.tail == nil {
+			continue
+		}
+		lines := proc.tail.contents()
+		if len(lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "multirun: %s exited abnormally, last lines of its stderr:\n", proc.name)
+		for _, line := range lines {
+			fmt.Fprintf(os.Stderr, "multirun:   %s\n", line)
+		}
+	}
+}
+
+// reportTimes lists how long each subprocess ran, with -timing.
+func (app *multirun) reportTimes() {
+	if !app.timing || len(app.subprocesses) == 0 {
+		return
+	}
+	var times []string
+	for _, pid := range app.sortedPids() {
+		proc := app.subprocesses[pid]
+		times = append(times, fmt.Sprintf("%s %s", proc.name, proc.runTime()))
+	}
+	fmt.Fprintf(os.Stderr, "multirun: run times: %s\n", strings.Join(times, ", "))
+}
+
+// controlRequest is a command received on the control socket, waiting for
+// the event loop to execute it.
+type controlRequest struct {
+	args  []string
+	reply chan string
+	quiet bool // not logged, for the periodic requests of -tui
+}
+
+// listenControl starts accepting control commands on a unix socket. Each
+// line received is a command, answered with zero or more lines of data
+// followed by either "ok" or "error: <reason>":
+//
+//	list                 one "name<TAB>pid<TAB>state<TAB>command" line per command
+//	status               the status of every command as a single line of JSON,
+//	                     as written to the -status-file
+//	signal <name> <sig>  send a signal to the process group of a command
+//	restart <name>       stop a command and start it again, then reply with
+//	                     a "name<TAB>pid" line
+//	drain                stop restarting and stopping commands, and exit once
+//	                     they all exited by themselves
+//	stop                 shut everything down, as on SIGTERM
+func (app *multirun) listenControl(path string) error {
+	// A socket left over by a previous run would make Listen fail.
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("control socket: %v", err)
+	}
+	app.control = l
+	logf(app.verbose, "listening for control commands on %s", path)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go app.serveControl(conn)
+		}
+	}()
+	return nil
+}
+
+// serveControl hands the commands of one connection over to the event loop
+// and writes back their replies.
+func (app *multirun) serveControl(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		req := controlRequest{args: args, reply: make(chan string, 1)}
+		select {
+		case app.controlChan <- req:
+			fmt.Fprint(conn, <-req.reply)
+		case <-app.done:
+			fmt.Fprintln(conn, "error: multirun is exiting")
+			return
+		}
+	}
+}
+
+// closeControl stops accepting control commands and removes the socket.
+func (app *multirun) closeControl() {
+	close(app.done)
+	if app.control != nil {
+		app.control.Close()
+	}
+}
+
+// tuiRefresh is how often -tui redraws the table of the commands.
+const tuiRefresh = 500 * time.Millisecond
+
+// tuiLogLines is how many lines of output -tui keeps to show below the table.
+const tuiLogLines = 1000
+
+// tui shows a live table of the commands on the terminal, for -tui. It takes
+// the terminal over: the output of the children and the messages of multirun
+// go through a pipe, and only the last lines fitting below the table are
+// shown. The table is built from the status and the keys are handled through
+// the control commands, so that the event loop remains the only one touching
+// the subprocesses.
+type tui struct {
+	app      *multirun
+	term     *os.File         // the terminal, as stdout was before
+	stderr   int              // a copy of the original stderr
+	termios  *syscall.Termios // the mode of stdin before it was made raw
+	log      *tailBuffer
+	keys     chan string
+	selected int
+	stopped  chan struct{} // closed once run stopped drawing
+}
+
+// startTUI takes the terminal over for -tui. stdin and stdout must be a
+// terminal.
+func (app *multirun) startTUI() (*tui, error) {
+	var termios syscall.Termios
+	if ioctl(os.Stdin.Fd(), syscall.TCGETS, unsafe.Pointer(&termios)) != nil ||
+		ioctl(os.Stdout.Fd(), syscall.TCGETS, unsafe.Pointer(&termios)) != nil {
+		return nil, fmt.Errorf("stdin or stdout is not a terminal")
+	}
+	stdout, err := syscall.Dup(1)
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := syscall.Dup(2)
+	if err != nil {
+		syscall.Close(stdout)
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		syscall.Close(stdout)
+		syscall.Close(stderr)
+		return nil, err
+	}
+	// The children inherit the pipe as their stdout and stderr.
+	syscall.Dup2(int(w.Fd()), 1)
+	syscall.Dup2(int(w.Fd()), 2)
+	w.Close()
+
+	// Keys are read one by one, without echo. Ctrl-C still sends SIGINT.
+	raw := termios
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	ioctl(os.Stdin.Fd(), syscall.TCSETS, unsafe.Pointer(&raw))
+
+	t := &tui{
+		app:     app,
+		term:    os.NewFile(uintptr(stdout), "terminal"),
+		stderr:  stderr,
+		termios: &termios,
+		log:     &tailBuffer{size: tuiLogLines},
+		keys:    make(chan string),
+		stopped: make(chan struct{}),
+	}
+	// Switch to the alternate screen and hide the cursor.
+	fmt.Fprint(t.term, "\x1b[?1049h\x1b[?25l")
+	go t.readLog(r)
+	go t.readKeys()
+	go t.run()
+	return t, nil
+}
+
+// closeTUI gives the terminal back, if -tui took it over, and prints the last
+// lines of output that fit on it. It must be called after closeControl,
+// which stops the drawing.
+func (app *multirun) closeTUI() {
+	t := app.tui
+	if t == nil {
+		return
+	}
+	app.tui = nil
+	<-t.stopped
+	ioctl(os.Stdin.Fd(), syscall.TCSETS, unsafe.Pointer(t.termios))
+	fmt.Fprint(t.term, "\x1b[?25h\x1b[?1049l")
+	syscall.Dup2(int(t.term.Fd()), 1)
+	syscall.Dup2(t.stderr, 2)
+	syscall.Close(t.stderr)
+	lines := t.log.contents()
+	rows := int(t.size().rows) - 1
+	if len(lines) > rows {
+		lines = lines[len(lines)-rows:]
+	}
+	for _, line := range lines {
+		fmt.Fprintln(t.term, line)
+	}
+	t.term.Close()
+}
+
+// size returns the size of the terminal, or 80x24 if unknown.
+func (t *tui) size() winsize {
+	size := winsize{rows: 24, cols: 80}
+	ioctl(t.term.Fd(), syscall.TIOCGWINSZ, unsafe.Pointer(&size))
+	return size
+}
+
+// readLog records the lines written to the pipe standing for stdout and
+// stderr.
+func (t *tui) readLog(r *os.File) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxLineLength)
+	for scanner.Scan() {
+		t.log.add(scanner.Text())
+	}
+}
+
+// readKeys hands the keys pressed over to run. The arrows are escape
+// sequences, which arrive in a single read.
+func (t *tui) readKeys() {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case t.keys <- string(buf[:n]):
+		case <-t.app.done:
+			return
+		}
+	}
+}
+
+// request sends a control command to the event loop and returns its reply,
+// or false once multirun is exiting.
+func (t *tui) request(quiet bool, args ...string) (string, bool) {
+	req := controlRequest{args: args, reply: make(chan string, 1), quiet: quiet}
+	select {
+	case t.app.controlChan <- req:
+		return <-req.reply, true
+	case <-t.app.done:
+		return "", false
+	}
+}
+
+// run redraws the table on every refresh and every key until multirun exits.
+func (t *tui) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(tuiRefresh)
+	defer ticker.Stop()
+	for {
+		reply, ok := t.request(true, "status")
+		if !ok {
+			return
+		}
+		var statuses []processStatus
+		json.Unmarshal([]byte(strings.TrimSuffix(reply, "\nok\n")), &statuses)
+		t.selected = min(t.selected, max(len(statuses)-1, 0))
+		t.draw(statuses)
+
+		select {
+		case <-ticker.C:
+		case key := <-t.keys:
+			t.handleKey(key, statuses)
+		case <-t.app.done:
+			return
+		}
+	}
+}
+
+// handleKey moves the selection with j and k or the arrows, restarts the
+// selected command on r, sends it SIGTERM on s, and stops everything on q as
+// Ctrl-C does.
+func (t *tui) handleKey(key string, statuses []processStatus) {
+	switch key {
+	case "j", "\x1b[B":
+		t.selected = min(t.selected+1, max(len(statuses)-1, 0))
+	case "k", "\x1b[A":
+		t.selected = max(t.selected-1, 0)
+	case "r", "s":
+		if t.selected >= len(statuses) {
+			return
+		}
+		name := statuses[t.selected].Name
+		args := []string{"signal", name, "TERM"}
+		if key == "r" {
+			args = []string{"restart", name}
+		}
+		// A restart is only answered once the command runs again.
+		go func() {
+			if reply, ok := t.request(false, args...); ok && strings.HasPrefix(reply, "error:") {
+				t.log.add("multirun: " + strings.TrimSpace(reply))
+			}
+		}()
+	case "q":
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+	}
+}
+
+// draw clears the screen and shows the table of the commands, followed by
+// the last lines of output that fit.
+func (t *tui) draw(statuses []processStatus) {
+	size := t.size()
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	up := 0
+	for _, status := range statuses {
+		if status.Up {
+			up++
+		}
+	}
+	fmt.Fprintf(&b, "multirun: %d of %d up    j/k: select  r: restart  s: stop  q: stop all\n\n", up, len(statuses))
+	fmt.Fprintf(&b, "  %-20s %8s  %-14s %10s %8s\n", "NAME", "PID", "STATUS", "UPTIME", "RESTARTS")
+	for i, status := range statuses {
+		state, uptime := "up", time.Since(status.StartedAt).Round(time.Second).String()
+		if !status.Up {
+			state, uptime = fmt.Sprintf("exited (%d)", *status.LastExitCode), "-"
+		}
+		line := fmt.Sprintf("  %-20s %8d  %-14s %10s %8d", status.Name, status.Pid, state, uptime, status.Restarts)
+		if i == t.selected {
+			line = "\x1b[7m" + line + "\x1b[0m"
+		}
+		b.WriteString(line + "\n")
+	}
+	b.WriteString("\n")
+	lines := t.log.contents()
+	if rows := int(size.rows) - len(statuses) - 5; len(lines) > rows {
+		lines = lines[len(lines)-max(rows, 0):]
+	}
+	for _, line := range lines {
+		if len(line) > int(size.cols) {
+			line = line[:size.cols]
+		}
+		b.WriteString(line + "\n")
+	}
+	t.term.WriteString(b.String())
+}
+
+// processStatus describes a subprocess in the JSON status.
+type processStatus struct {
+	Pid          int            `json:"pid"`
+	Name         string         `json:"name"`
+	Command      string         `json:"command"`
+	Up           bool           `json:"up"`
+	StartedAt    time.Time      `json:"startedAt"`
+	LastExitCode *int           `json:"lastExitCode"`
+	Restarts     int            `json:"restarts"`
+	Usage        *resourceUsage `json:"usage,omitempty"` // of the last run, once exited
+	// Set when the output goes through multirun.
+	OutputLines  *int64     `json:"outputLines,omitempty"`
+	LastOutputAt *time.Time `json:"lastOutputAt,omitempty"`
+}
+
+// status returns a JSON array describing every subprocess, on a single line.
+func (app *multirun) status() []byte {
+	statuses := []processStatus{}
+	for _, pid := range app.sortedPids() {
+		proc := app.subprocesses[pid]
+		status := processStatus{
+			Pid:       pid,
+			Name:      proc.name,
+			Command:   proc.command,
+			Up:        proc.up,
+			StartedAt: proc.started,
+			Restarts:  proc.restarts,
+		}
+		if !proc.up {
+			status.LastExitCode = &proc.exitCode
+			status.Usage = proc.resourceUsage()
+		} else {
+			status.LastExitCode = proc.lastExitCode
+		}
+		if proc.activity != nil {
+			lines, last := proc.activity.snapshot()
+			status.OutputLines = &lines
+			if lines > 0 {
+				status.LastOutputAt = &last
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	data, _ := json.Marshal(statuses)
+	return data
+}
+
+// writeStatusFile replaces -status-file with the current status.
+func (app *multirun) writeStatusFile() error {
+	if err := writeFileAtomic(app.statusFile, append(app.status(), '\n')); err != nil {
+		return err
+	}
+	logf(app.verbose, "wrote status to %s", app.statusFile)
+	return nil
+}
+
+// reportEntry describes the outcome of a subprocess in the -report file.
+type reportEntry struct {
+	Name            string         `json:"name"`
+	Command         string         `json:"command"`
+	Pid             int            `json:"pid"`
+	ExitCode        int            `json:"exitCode"`
+	Signal          string         `json:"signal,omitempty"`
+	Meaning         string         `json:"meaning,omitempty"`
+	PossibleOOMKill bool           `json:"possibleOOMKill,omitempty"`
+	StartedAt       time.Time      `json:"startedAt"`
+	DurationSeconds float64        `json:"durationSeconds"`
+	Usage           *resourceUsage `json:"usage,omitempty"`
+}
+
+// configEntry describes how a command is run, for -show-config.
+type configEntry struct {
+	Name         string   `json:"name"`
+	Command      string   `json:"command"`
+	Argv         []string `json:"argv"`
+	Dir          string   `json:"dir"`
+	Env          []string `json:"env,omitempty"`
+	Grace        string   `json:"grace,omitempty"`
+	StopPriority int      `json:"stopPriority"`
+	Essential    bool     `json:"essential"`
+	Stdin        bool     `json:"stdin,omitempty"`
+	User         string   `json:"user,omitempty"`
+	Nice         *int     `json:"nice,omitempty"`
+	Umask        string   `json:"umask,omitempty"`
+	Rlimit       string   `json:"rlimit,omitempty"`
+	CPUs         string   `json:"cpus,omitempty"`
+	MapSignal    string   `json:"mapSignal,omitempty"`
+}
+
+// resolveConfig combines the global and per-command settings into the
+// configuration of each command. env holds the -env-file variables, and specs
+// the raw values of the per-command flags that are shown as given, by flag
+// name without the dash.
+func (app *multirun) resolveConfig(commands, env []string, specs map[string]perCommand) []configEntry {
+	dir, _ := os.Getwd()
+	names := commandNames(commands)
+	entries := make([]configEntry, len(commands))
+	for i, command := range commands {
+		name := names[i]
+		entry := configEntry{
+			Name:         name,
+			Command:      command,
+			Argv:         []string{"sh", "-c", app.shellScript(name, command)},
+			Dir:          dir,
+			Env:          env,
+			StopPriority: app.stopPriority[name],
+			Essential:    app.isEssential(name),
+			Stdin:        name == app.stdinTarget,
+			User:         specs["user"][name],
+			Rlimit:       specs["rlimit"][name],
+			CPUs:         specs["cpus"][name],
+			MapSignal:    specs["map-signal"][name],
+		}
+		if grace := app.graceOf(name); grace > 0 {
+			entry.Grace = grace.String()
+		}
+		if nice, ok := app.niceness[name]; ok {
+			entry.Nice = &nice
+		}
+		if umask, ok := app.umasks[name]; ok {
+			entry.Umask = fmt.Sprintf("%04o", umask)
+		}
+		entries[i] = entry
+	}
+	return entries
+}
+
+// writeConfig prints the configuration of the commands to w, as "text" or
+// "json".
+func writeConfig(w io.Writer, entries []configEntry, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	var b strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "%s: %s\n", entry.Name, entry.Command)
+		field := func(key, value string) {
+			if value != "" {
+				fmt.Fprintf(&b, "  %-14s %s\n", key+":", value)
+			}
+		}
+		argv := make([]string, len(entry.Argv))
+		for i, arg := range entry.Argv {
+			argv[i] = strconv.Quote(arg)
+		}
+		field("argv", strings.Join(argv, " "))
+		field("dir", entry.Dir)
+		for _, v := range entry.Env {
+			field("env", v)
+		}
+		field("grace", entry.Grace)
+		field("stop-priority", strconv.Itoa(entry.StopPriority))
+		field("essential", strconv.FormatBool(entry.Essential))
+		if entry.Stdin {
+			field("stdin", "true")
+		}
+		field("user", entry.User)
+		if entry.Nice != nil {
+			field("nice", strconv.Itoa(*entry.Nice))
+		}
+		field("umask", entry.Umask)
+		field("rlimit", entry.Rlimit)
+		field("cpus", entry.CPUs)
+		field("map-signal", entry.MapSignal)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// abort ends multirun when the commands cannot run, or none of them could be
+// started: it releases what was set up so far, writes the -report, which
+// lists the commands started if any, and exits with code.
+func (app *multirun) abort(code int, report string) {
+	app.closeControl()
+	app.closeTUI()
+	app.closeCgroup()
+	app.writeReportFile(report)
+	os.Exit(code)
+}
+
+// writeReportFile writes the -report file, if any. Errors are reported but
+// do not change the exit code.
+func (app *multirun) writeReportFile(path string) {
+	if path == "" {
+		return
+	}
+	if err := app.writeReport(path); err != nil {
+		fmt.Fprintf(os.Stderr, "multirun: error writing report: %v\n", err)
+	}
+}
+
+// writeReport writes the outcome of every subprocess to path, once they all
+// exited.
+func (app *multirun) writeReport(path string) error {
+	entries := []reportEntry{}
+	for _, pid := range app.sortedPids() {
+		proc := app.subprocesses[pid]
+		entry := reportEntry{
+			Name:            proc.name,
+			Command:         proc.command,
+			Pid:             pid,
+			ExitCode:        proc.exitCode,
+			StartedAt:       proc.started,
+			DurationSeconds: proc.exited.Sub(proc.started).Seconds(),
+		}
+		if proc.exitSignal != 0 {
+			entry.Signal = signalName(proc.exitSignal)
+		}
+		entry.Meaning = proc.meanings[proc.exitCode]
+		entry.PossibleOOMKill = proc.possibleOOM
+		entry.Usage = proc.resourceUsage()
+		entries = append(entries, entry)
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// writeFileAtomic replaces the file at path with data. The file is renamed
+// into place so that readers never see it half written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeExitCode replaces NAME.exitcode in -exitcode-dir with the exit code of
+// the subprocess, followed by the name of the signal that killed it if any.
+func (app *multirun) writeExitCode(p *subprocess) error {
+	line := strconv.Itoa(p.exitCode)
+	if p.exitSignal != 0 {
+		line += " " + signalName(p.exitSignal)
+	}
+	return writeFileAtomic(filepath.Join(app.exitCodeDir, p.name+".exitcode"), []byte(line+"\n"))
+}
+
+// sendControl sends a control command to the multirun listening on socket,
+// writes the data lines of the reply to stdout and the error, if any, to
+// stderr, and returns the exit code of multirun -send.
+func sendControl(socket, command string) int {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "multirun: -send: %v\n", err)
+		return exitStartup
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		fmt.Fprintf(os.Stderr, "multirun: -send: %v\n", err)
+		return exitStartup
+	}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "ok" {
+			return exitSuccess
+		}
+		// Data lines may start with "error" too, e.g. the name of a
+		// command in the list.
+		if strings.HasPrefix(line, "error: ") {
+			fmt.Fprintf(os.Stderr, "multirun: %s\n", line)
+			return exitChildFailure
+		}
+		fmt.Println(line)
+	}
+	fmt.Fprintln(os.Stderr, "multirun: -send: the connection was closed before the reply ended")
+	return exitStartup
+}
+
+// handleControl executes a control command on behalf of the event loop and
+// returns its reply. stop is true when a shutdown was requested.
+func (app *multirun) handleControl(args []string) (reply string, stop bool) {
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		var b strings.Builder
+		for _, pid := range app.sortedPids() {
+			proc := app.subprocesses[pid]
+			state := "exited"
+			if proc.up {
+				state = "up"
+			}
+			fmt.Fprintf(&b, "%s\t%d\t%s\t%s\n", proc.name, pid, state, proc.command)
+		}
+		return b.String() + "ok\n", false
+	case args[0] == "status" && len(args) == 1:
+		return string(app.status()) + "\nok\n", false
+	case args[0] == "signal" && len(args) == 3:
+		sig, err := parseSignal(args[2])
+		if err != nil {
+			return fmt.Sprintf("error: %v\n", err), false
+		}
+		for _, proc := range app.subprocesses {
+			if proc.name == args[1] && proc.up {
+				proc.signal(sig)
+				return "ok\n", false
+			}
+		}
+		return fmt.Sprintf("error: no running command named %q\n", args[1]), false
+	case args[0] == "stop" && len(args) == 1:
+		return "ok\n", true
+	}
+	return fmt.Sprintf("error: unknown command %q\n", strings.Join(args, " ")), false
+}
+
+// restartCommand restarts the named command, after its -watch paths changed
+// or on the restart control command. A running command is stopped and
+// launched again once it exited, as the exit handler sees it marked. One that
+// exited already is launched again right away, in which case restartCommand
+// returns true, unless it is marked too: it waits for its -restart-delay,
+// and is launched once only. reply, if not nil, is answered once the command
+// runs again or could not be restarted.
+func (app *multirun) restartCommand(name string, reply chan string) bool {
+	for _, proc := range app.subprocesses {
+		if proc.name != name {
+			continue
+		}
+		if reply != nil {
+			proc.restartReplies = append(proc.restartReplies, reply)
+		}
+		if !proc.up && proc.restart {
+			logf(app.verbose, "%s is already waiting to be started again", name)
+			return false
+		}
+		if !proc.up {
+			logf(app.verbose, "starting %s again", name)
+			return app.relaunch(proc) != nil
+		}
+		if !proc.restart {
+			sig := syscall.SIGTERM
+			if app.forcedStop != 0 {
+				sig = app.forcedStop
+			}
+			logf(app.verbose, "stopping %s to restart it", name)
+			proc.restart = true
+			proc.signal(proc.translate(sig))
+		}
+		return false
+	}
+	if reply != nil {
+		reply <- fmt.Sprintf("error: no command named %q\n", name)
+	}
+	return false
+}
+
+// relaunch starts the command of an exited subprocess again, under the same
+// name. The new subprocess replaces the old one, which is forgotten, or nil
+// is returned if it could not be started.
+func (app *multirun) relaunch(old *subprocess) *subprocess {
+	pid := old.process.Pid()
+	delete(app.subprocesses, pid)
+	next := app.launch(old.command, old.name)
+	if next == nil {
+		old.restart = false
+		app.subprocesses[pid] = old
+		old.answerRestart(fmt.Sprintf("error: %s could not be started again\n", old.name))
+		return nil
+	}
+	next.restarts = old.restarts + 1
+	code := old.exitCode
+	next.lastExitCode = &code
+	logf(app.verbose, "restarted %s with pid %d", next.name, next.process.Pid())
+	old.answerRestart(fmt.Sprintf("%s\t%d\nok\n", next.name, next.process.Pid()))
+	return next
+}
+
+// answerRestart replies to the control connections waiting for the restart
+// of the subprocess.
+func (p *subprocess) answerRestart(reply string) {
+	for _, c := range p.restartReplies {
+		c <- reply
+	}
+	p.restartReplies = nil
+}
+
+// sortedPids returns the pids of all subprocesses in ascending order.
+func (app *multirun) sortedPids() []int {
+	pids := make([]int, 0, len(app.subprocesses))
+	for pid := range app.subprocesses {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// pipesOutput reports whether the output of the children goes through
+// multirun rather than straight to its own stdout and stderr.
+func (app *multirun) pipesOutput() bool {
+	return app.grep != nil || app.maxRate > 0 || app.tailLines > 0 || app.useSyslog || app.prefix != nil || app.pty || app.trackOutput || len(app.patterns) > 0
+}
+
+// outputWriter builds the writer one of the streams of a child is copied to,
+// recording its lines in tail if not nil and, with -syslog, sending them to
+// syslog with the given priority. Without any filtering the destination is
+// returned as is, so that the child writes to it directly instead of through
+// a pipe. In quiet mode, nil is returned when nothing is recorded, which
+// connects the stream to /dev/null.
+func (app *multirun) outputWriter(proc *subprocess, dst io.Writer, tail *tailBuffer, priority syslog.Priority) io.Writer {
+	var logger *syslog.Writer
+	if app.useSyslog {
+		var err error
+		if logger, err = syslog.Dial("", "", priority, proc.name); err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: error connecting %s to syslog: %v\n", proc.name, err)
+		} else {
+			proc.loggers = append(proc.loggers, logger)
+		}
+	}
+	if app.quiet {
+		if tail == nil && logger == nil && !app.trackOutput && proc.ready == nil {
+			return nil
+		}
+		dst = io.Discard
+	} else if app.grep == nil && app.maxRate <= 0 && app.prefix == nil && tail == nil && logger == nil && !app.trackOutput && proc.ready == nil {
+		return dst
+	}
+	var w io.Writer = dst
+	// In quiet mode nothing is shown, so there is nothing to filter.
+	if !app.quiet {
+		if app.prefix != nil {
+			w = &prefixWriter{format: app.prefix, proc: proc, next: w}
+		}
+		if app.maxRate > 0 {
+			// The limit applies to stdout and stderr together.
+			if proc.rate == nil {
+				proc.rate = &rateLimit{name: proc.name, limit: app.maxRate}
+			}
+			w = &rateWriter{rate: proc.rate, next: w}
+		}
+		if app.grep != nil {
+			w = &grepWriter{re: app.grep, next: w}
+		}
+	}
+	// The tail, syslog and -ready-pattern see every line, including the
+	// ones filtered out above.
+	if proc.ready != nil {
+		w = &readyWriter{re: app.patterns[proc.name], proc: proc, next: w}
+	}
+	if tail != nil {
+		w = &tailWriter{tail: tail, next: w}
+	}
+	if logger != nil {
+		w = &syslogWriter{log: logger, next: w}
+	}
+	// The activity covers stdout and stderr together.
+	if proc.activity == nil {
+		proc.activity = &outputActivity{}
+	}
+	w = &activityWriter{activity: proc.activity, next: w}
+	lw := &lineWriter{next: w}
+	proc.outputs = append(proc.outputs, lw)
+	return lw
+}
+
+// shutdown starts stopping all running subprocesses with the given signal.
+// Subprocesses are stopped by ascending priority: the ones sharing the
+// lowest priority are signaled first, and each following priority is only
+// signaled once every subprocess with a lower priority has exited.
+//
+// Descendants that left the process group of their child, typically by
+// calling setsid, would not be reached that way: they are signaled
+// individually right away.
+func (app *multirun) shutdown(signal syscall.Signal) {
+	app.stopSignal = signal
+	app.advanceShutdown()
+	app.signalEscaped(signal)
+}
+
+// signalEscaped sends a signal to every escaped descendant.
+func (app *multirun) signalEscaped(signal syscall.Signal) {
+	for _, pid := range app.descendants() {
+		logf(app.verbose, "sending %s to escaped descendant with pid %d", signal, pid)
+		if err := syscall.Kill(pid, signal); err != nil && err != syscall.ESRCH {
+			fmt.Fprintf(os.Stderr, "multirun: error killing process %d: %v\n", pid, err)
+		}
+	}
+}
+
+// reapOrphans waits for the processes that were reparented to multirun, as
+// a subreaper, and have exited since. Children started by multirun are left
+// alone: their own goroutine waits for them.
+func (app *multirun) reapOrphans() {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return
+	}
+	self := os.Getpid()
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if _, ok := app.subprocesses[pid]; ok || app.isHook(pid) {
+			continue
+		}
+		if ppid, _, err := procStat(pid); err != nil || ppid != self {
+			continue
+		}
+		var ws syscall.WaitStatus
+		if reaped, _ := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil); reaped == pid {
+			logf(app.verbose, "reaped orphaned process with pid %d", pid)
+		}
+	}
+}
+
+// serviceEnv is the environment variable that marks the descendants of a
+// -forking command with its name.
+const serviceEnv = "MULTIRUN_SERVICE"
+
+// followDaemon looks, once a -forking command exited successfully, for the
+// process it daemonized into: an orphan reparented to multirun, as a
+// subreaper, that inherited the serviceEnv mark of the command. If there is
+// one, the subprocess carries on with it and followDaemon returns true.
+func (app *multirun) followDaemon(p *subprocess) bool {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return false
+	}
+	self := os.Getpid()
+	mark := "\x00" + serviceEnv + "=" + p.name + "\x00"
+	daemon := 0
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if _, ok := app.subprocesses[pid]; ok || app.isHook(pid) {
+			continue
+		}
+		if ppid, _, err := procStat(pid); err != nil || ppid != self {
+			continue
+		}
+		environ, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+		if err != nil || !strings.Contains("\x00"+string(environ), mark) {
+			continue
+		}
+		// The first one forked, normally with the lowest pid, is the daemon,
+		// the others its workers.
+		if daemon == 0 || pid < daemon {
+			daemon = pid
+		}
+	}
+	if daemon == 0 {
+		return false
+	}
+	logf(app.verbose, "%s with pid %d daemonized, following pid %d", p.name, p.process.Pid(), daemon)
+	delete(app.subprocesses, p.process.Pid())
+	p.process = adoptExecProcess(p.command, daemon)
+	p.err = nil
+	app.subprocesses[daemon] = p
+	go app.waitSubprocess(p)
+	return true
+}
+
+// escapedDescendants walks /proc to find the descendants of multirun that are
+// not in the process group of one of its running children.
+func (app *multirun) escapedDescendants() []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	children := make(map[int][]int)
+	pgids := make(map[int]int)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		ppid, pgid, err := procStat(pid)
+		if err != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], pid)
+		pgids[pid] = pgid
+	}
+
+	var escaped []int
+	queue := children[os.Getpid()]
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		queue = append(queue, children[pid]...)
+		if proc, ok := app.subprocesses[pgids[pid]]; ok && proc.up {
+			continue
+		}
+		if _, ok := app.subprocesses[pid]; ok || app.isBoundedHook(pgids[pid]) {
+			continue
+		}
+		escaped = append(escaped, pid)
+	}
+	return escaped
+}
+
+// procStat reads the parent pid and the process group of a process from
+// /proc/<pid>/stat.
+func procStat(pid int) (ppid, pgid int, err error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	// The command name may contain spaces and parentheses, so the fields are
+	// counted from the last closing parenthesis: state, ppid, pgrp...
+	fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+	if len(fields) < 3 {
+		return 0, 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	if ppid, err = strconv.Atoi(fields[1]); err != nil {
+		return 0, 0, err
+	}
+	if pgid, err = strconv.Atoi(fields[2]); err != nil {
+		return 0, 0, err
+	}
+	return ppid, pgid, nil
+}
+
+// userHZ is the unit of the times in /proc/<pid>/stat, which Linux fixes at
+// 100 per second for userspace.
+const userHZ = 100
+
+// processAge returns how long ago the process pid started, from its start
+// time in /proc/<pid>/stat and the uptime in /proc/uptime, both counted from
+// boot.
+func processAge(pid int) (time.Duration, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// starttime is the 22nd field, the 20th from the state.
+	fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	data, err = os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	uptime, _, _ := strings.Cut(string(data), " ")
+	seconds, err := strconv.ParseFloat(uptime, 64)
+	if err != nil {
+		return 0, err
+	}
+	age := time.Duration(seconds*float64(time.Second)) - time.Duration(ticks)*time.Second/userHZ
+	return max(age, 0), nil
+}
+
+// watchDebounce is how long -watch waits for changes to settle before
+// restarting the commands.
+const watchDebounce = 200 * time.Millisecond
+
+// watchSpec is a -watch path and the name of the command to restart when it
+// changes.
+type watchSpec struct {
+	path string
+	name string
+}
+
+// watchSpecs is a repeatable flag of the form PATH:NAME.
+type watchSpecs []watchSpec
+
+func (w *watchSpecs) String() string {
+	specs := make([]string, len(*w))
+	for i, spec := range *w {
+		specs[i] = spec.path + ":" + spec.name
+	}
+	return strings.Join(specs, ",")
+}
+
+func (w *watchSpecs) Set(value string) error {
+	// The name comes last, as paths may contain colons.
+	i := strings.LastIndexByte(value, ':')
+	if i <= 0 || i == len(value)-1 {
+		return fmt.Errorf("expected PATH:NAME, got %q", value)
+	}
+	*w = append(*w, watchSpec{path: value[:i], name: value[i+1:]})
+	return nil
+}
+
+// watchTarget is what an inotify watch descriptor stands for.
+type watchTarget struct {
+	dir  string // the watched directory
+	file string // the only entry of dir that matters, empty for all of them
+	name string // the command to restart
+}
+
+// watcher reports through inotify the commands whose -watch paths changed.
+type watcher struct {
+	fd      int
+	targets map[int][]watchTarget // by watch descriptor, owned by run once started
+	changes chan string
+}
+
+// watchMask selects the inotify events that denote a change. Editors often
+// save by renaming a new file over the old one, hence the moves.
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// newWatcher sets up the inotify watches of the -watch paths. A file is
+// watched through its directory, so that it is still watched once replaced.
+// A directory is watched with all its subdirectories.
+func newWatcher(specs []watchSpec) (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &watcher{fd: fd, targets: make(map[int][]watchTarget), changes: make(chan string)}
+	for _, spec := range specs {
+		info, err := os.Stat(spec.path)
+		if err == nil && !info.IsDir() {
+			err = w.add(watchTarget{dir: filepath.Dir(spec.path), file: filepath.Base(spec.path), name: spec.name})
+		} else if err == nil {
+			err = w.addTree(spec.path, spec.name)
+		}
+		if err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// add starts watching the directory of a target.
+func (w *watcher) add(target watchTarget) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, target.dir, watchMask)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: target.dir, Err: err}
+	}
+	w.targets[wd] = append(w.targets[wd], target)
+	return nil
+}
+
+// addTree watches a directory and all its subdirectories.
+func (w *watcher) addTree(root, name string) error {
+	return filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return err
+		}
+		return w.add(watchTarget{dir: path, name: name})
+	})
+}
+
+// run reads the inotify events and sends the name of the command to restart
+// for each change, until reading fails.
+func (w *watcher) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			fmt.Fprintf(os.Stderr, "multirun: -watch: stopped watching: %v\n", err)
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			entry := string(bytes.TrimRight(buf[start:start+int(event.Len)], "\x00"))
+			offset = start + int(event.Len)
+			w.handle(int(event.Wd), event.Mask, entry)
+		}
+	}
+}
+
+// handle reports the commands affected by an event on entry, in the
+// directory watched by wd. New subdirectories of a watched tree are watched
+// too.
+func (w *watcher) handle(wd int, mask uint32, entry string) {
+	for _, target := range w.targets[wd] {
+		if target.file != "" && target.file != entry {
+			continue
+		}
+		if target.file == "" && mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			if err := w.addTree(filepath.Join(target.dir, entry), target.name); err != nil {
+				fmt.Fprintf(os.Stderr, "multirun: -watch: %v\n", err)
+			}
+		}
+		w.changes <- target.name
+	}
+}
+
+// winsize is struct winsize from sys/ioctl.h.
+type winsize struct {
+	rows, cols, xpixel, ypixel uint16
+}
+
+// openPty allocates a pseudo-terminal and returns its two ends. The slave end
+// is set up for a child whose output is logged rather than displayed: it does
+// not turn newlines into CRLF, and it has the size of the terminal of
+// multirun, or 80x24.
+func openPty() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unlock int32
+	var n uint32
+	if err = fileIoctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err == nil {
+		err = fileIoctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n))
+	}
+	if err == nil {
+		slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	}
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	var termios syscall.Termios
+	if err = ioctl(slave.Fd(), syscall.TCGETS, unsafe.Pointer(&termios)); err == nil {
+		termios.Oflag &^= syscall.ONLCR
+		err = ioctl(slave.Fd(), syscall.TCSETS, unsafe.Pointer(&termios))
+	}
+	if err == nil {
+		size := terminalSize()
+		err = ioctl(slave.Fd(), syscall.TIOCSWINSZ, unsafe.Pointer(&size))
+	}
+	if err != nil {
+		master.Close()
+		slave.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// terminalSize returns the size of the terminal of multirun, or 80x24 if its
+// stdout is not a terminal.
+func terminalSize() winsize {
+	size := winsize{rows: 24, cols: 80}
+	ioctl(os.Stdout.Fd(), syscall.TIOCGWINSZ, unsafe.Pointer(&size))
+	return size
+}
+
+// resizePtys gives the ptys of the running children the current size of the
+// terminal of multirun. The kernel then sends SIGWINCH to their foreground
+// process groups.
+func (app *multirun) resizePtys() {
+	size := terminalSize()
+	for _, pid := range app.sortedPids() {
+		proc := app.subprocesses[pid]
+		if !proc.up || proc.ptyMaster == nil {
+			continue
+		}
+		if err := fileIoctl(proc.ptyMaster, syscall.TIOCSWINSZ, unsafe.Pointer(&size)); err != nil {
+			logf(app.verbose, "error resizing the pty of %s: %v", proc.name, err)
+		}
+	}
+}
+
+// fileIoctl performs an ioctl on f without Fd, which would turn the file to
+// blocking mode: a read of the master end of a pty must remain interruptible
+// by Close.
+func fileIoctl(f *os.File, request uintptr, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if err := conn.Control(func(fd uintptr) { err = ioctl(fd, request, arg) }); err != nil {
+		return err
+	}
+	return err
+}
+
+// ioctl performs an ioctl whose argument is a pointer.
+func ioctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// killSurvivors sends SIGKILL to the running subprocesses whose grace period,
+// counted from since, expired, and returns when the next one expires, or the
+// zero time if none is pending. A subprocess that created its
+// -shutdown-ready-file is killed without waiting for its grace period to
+// expire. While the -shutdown-wait-file exists, each kill is postponed by
+// another grace period at most. Once the last survivor is killed, so are the
+// escaped descendants and the -cgroup.
+func (app *multirun) killSurvivors(since time.Time) (next time.Time) {
+	now := app.clock.Now()
+	waiting := false
+	if app.waitFile != "" {
+		_, err := os.Stat(app.waitFile)
+		waiting = err == nil
+	}
+	pending := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	killed := false
+	for _, pid := range app.sortedPids() {
+		proc := app.subprocesses[pid]
+		if !proc.up || proc.killSent || proc.grace <= 0 {
+			continue
+		}
+		deadline := since.Add(proc.grace)
+		if path, ok := app.readyToDie[proc.name]; ok && now.Before(deadline) {
+			if _, err := os.Stat(path); err == nil {
+				logf(app.verbose, "%s exists, killing %s (pid %d)", path, proc.name, pid)
+				proc.signal(syscall.SIGKILL)
+				killed = true
+				continue
+			}
+			pending(deadline)
+			pending(now.Add(shutdownWaitPoll))
+			continue
+		}
+		if now.Before(deadline) {
+			pending(deadline)
+			continue
+		}
+		if waiting && now.Before(deadline.Add(proc.grace)) {
+			logf(app.verbose, "%s still exists, postponing the kill of %s", app.waitFile, proc.name)
+			pending(now.Add(shutdownWaitPoll))
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "multirun: grace period of %s expired, killing %s (pid %d)\n", proc.grace, proc.name, pid)
+		proc.signal(syscall.SIGKILL)
+		app.killedAfter = max(app.killedAfter, proc.grace)
+		killed = true
+	}
+	if killed && next.IsZero() {
+		app.signalEscaped(syscall.SIGKILL)
+		if app.cgroup != nil {
+			if err := app.cgroup.kill(); err != nil {
+				fmt.Fprintf(os.Stderr, "multirun: error killing the cgroup: %v\n", err)
+			}
+		}
+	}
+	return next
+}
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroup2SuperMagic identifies a cgroup v2 file system, from linux/magic.h.
+const cgroup2SuperMagic = 0x63677270
+
+// cgroup is a transient cgroup v2 holding all the children and their
+// descendants, which cannot leave it the way they can leave a process group.
+type cgroup struct {
+	path string
+	fd   int // an open directory, for SysProcAttr.CgroupFD
+}
+
+// createCgroup creates the cgroup of multirun, below the cgroup multirun
+// itself runs in. It is named after the pid of multirun, so that the image
+// started by an upgrade finds it again.
+func createCgroup() (*cgroup, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(cgroupRoot, &fs); err != nil {
+		return nil, err
+	}
+	if fs.Type != cgroup2SuperMagic {
+		return nil, fmt.Errorf("%s is not a cgroup v2 hierarchy", cgroupRoot)
+	}
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, err
+	}
+	// With cgroup v2 only, the file is a single "0::/path" line.
+	var parent string
+	for _, line := range strings.Split(string(data), "\n") {
+		if rest, ok := strings.CutPrefix(line, "0::"); ok {
+			parent = rest
+		}
+	}
+	if parent == "" {
+		return nil, fmt.Errorf("no cgroup v2 entry in /proc/self/cgroup")
+	}
+	path := filepath.Join(cgroupRoot, parent, fmt.Sprintf("multirun-%d", os.Getpid()))
+	if err := os.Mkdir(path, 0o755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return &cgroup{path: path, fd: fd}, nil
+}
+
+// kill kills every process left in the cgroup. cgroup.kill needs Linux 5.14,
+// older kernels get a SIGKILL for each process listed in cgroup.procs.
+func (cg *cgroup) kill() error {
+	err := os.WriteFile(filepath.Join(cg.path, "cgroup.kill"), []byte("1"), 0)
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(cg.path, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	for _, field := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+	return nil
+}
+
+// pids lists the processes in the cgroup.
+func (cg *cgroup) pids() []string {
+	data, _ := os.ReadFile(filepath.Join(cg.path, "cgroup.procs"))
+	return strings.Fields(string(data))
+}
+
+// closeCgroup kills the processes that outlived the children in the -cgroup
+// and removes it. The kernel only lets an empty cgroup go, so the removal is retried
+// for a short while as the killed processes vanish.
+func (app *multirun) closeCgroup() {
+	cg := app.cgroup
+	if cg == nil {
+		return
+	}
+	if survivors := cg.pids(); len(survivors) > 0 {
+		logf(app.verbose, "killing %d processes left in %s", len(survivors), cg.path)
+		if err := cg.kill(); err != nil {
+			fmt.Fprintf(os.Stderr, "multirun: error killing the cgroup: %v\n", err)
+		}
+	}
+	syscall.Close(cg.fd)
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = syscall.Rmdir(cg.path); err != syscall.EBUSY {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "multirun: error removing %s: %v\n", cg.path, err)
+	}
+}
+
+// advanceShutdown signals the running subprocesses with the lowest priority
+// that have not been asked to stop yet. It must be called again every time a
+// subprocess exits during a shutdown, and does nothing until shutdown has
+// been called.
+func (app *multirun) advanceShutdown() {
+	if app.stopSignal == 0 {
+		return
+	}
+	priority, found := 0, false
+	for _, proc := range app.subprocesses {
+		if proc.up && (!found || proc.priority < priority) {
+			priority, found = proc.priority, true
+		}
+	}
+	if !found {
+		return
+	}
+	for pid, proc := range app.subprocesses {
+		if proc.up && proc.priority == priority && !proc.stopping {
+			proc.stopping = true
+			sig := proc.translate(app.stopSignal)
+			logf(app.verbose, "sending %s to %s (pid %d)", sig, proc.name, pid)
+			proc.signal(sig)
+		}
+	}
+}
+
+// relay sends the given signal to the process group of every running
+// subprocess.
+func (app *multirun) relay(signal syscall.Signal) {
+	for _, proc := range app.subprocesses {
+		if proc.up {
+			proc.signal(proc.translate(signal))
+		}
+	}
+}
+
+// translate returns the signal sent to the subprocess in place of sig, as
+// configured with -map-signal.
+func (p *subprocess) translate(sig syscall.Signal) syscall.Signal {
+	if to, ok := p.signalMap[sig]; ok {
+		return to
+	}
+	return sig
+}
+
+// signal sends a signal to the process group of the subprocess. Groups that
+// already vanished are silently ignored.
+func (p *subprocess) signal(signal syscall.Signal) {
+	if signal == syscall.SIGKILL {
+		p.killSent = true
+	}
+	if err := p.process.Signal(signal); err != nil {
+		if err != syscall.ESRCH {
+			fmt.Fprintf(os.Stderr, "multirun: error killing process group %d: %v\n", p.process.Pid(), err)
+		}
+	}
+}
+
+// maxLineLength bounds the size of a buffered line. Longer lines are split.
+const maxLineLength = 64 * 1024
+
+// lineWriter splits the output of a child into lines and hands each complete
+// line, including its trailing newline, to the next writer in a single Write
+// call. The writers after it can therefore work line by line.
+type lineWriter struct {
+	mu   sync.Mutex
+	next io.Writer
+	buf  []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	start := 0
+	for {
+		i := bytes.IndexByte(w.buf[start:], '\n')
+		if i < 0 {
+			break
+		}
+		w.next.Write(w.buf[start : start+i+1])
+		start += i + 1
+	}
+	for len(w.buf)-start >= maxLineLength {
+		w.next.Write(w.buf[start : start+maxLineLength])
+		start += maxLineLength
+	}
+	w.buf = w.buf[:copy(w.buf, w.buf[start:])]
+	return len(p), nil
+}
+
+// Flush hands a trailing partial line, if any, to the next writer. The line
+// is completed with a newline, so that the output of another child does not
+// follow it on the same line.
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.next.Write(append(w.buf, '\n'))
+		w.buf = w.buf[:0]
+	}
+}
+
+// grepWriter only forwards the lines matching a regular expression.
+type grepWriter struct {
+	re   *regexp.Regexp
+	next io.Writer
+}
+
+func (w *grepWriter) Write(line []byte) (int, error) {
+	if w.re.Match(bytes.TrimSuffix(line, []byte("\n"))) {
+		return w.next.Write(line)
+	}
+	return len(line), nil
+}
+
+// prefixFormat is a parsed -prefix-format: a sequence of literal texts and
+// placeholders, rendered for each line.
+type prefixFormat []func(p *subprocess) string
+
+// prefixPlaceholders maps the placeholders of -prefix-format to the values
+// they stand for.
+var prefixPlaceholders = map[string]func(p *subprocess) string{
+	"name":    func(p *subprocess) string { return p.name },
+	"pid":     func(p *subprocess) string { return strconv.Itoa(p.process.Pid()) },
+	"command": func(p *subprocess) string { return p.command },
+	"time":    func(p *subprocess) string { return time.Now().Format(time.RFC3339) },
+}
+
+// parsePrefixFormat parses a prefix template such as "[{name}:{pid}] ".
+func parsePrefixFormat(spec string) (prefixFormat, error) {
+	var format prefixFormat
+	for spec != "" {
+		open := strings.IndexByte(spec, '{')
+		if open < 0 {
+			open = len(spec)
+		}
+		if literal := spec[:open]; literal != "" {
+			format = append(format, func(*subprocess) string { return literal })
+		}
+		if open == len(spec) {
+			break
+		}
+		end := strings.IndexByte(spec[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder in %q", spec)
+		}
+		name := spec[open+1 : open+end]
+		placeholder, ok := prefixPlaceholders[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown placeholder {%s}", name)
+		}
+		format = append(format, placeholder)
+		spec = spec[open+end+1:]
+	}
+	return format, nil
+}
+
+// render returns the prefix of the next line of p.
+func (f prefixFormat) render(p *subprocess) string {
+	var b strings.Builder
+	for _, part := range f {
+		b.WriteString(part(p))
+	}
+	return b.String()
+}
+
+// prefixWriter prepends a -prefix-format to each line.
+type prefixWriter struct {
+	format prefixFormat
+	proc   *subprocess
+	next   io.Writer
+}
+
+func (w *prefixWriter) Write(line []byte) (int, error) {
+	// A single Write keeps the lines of concurrent children from
+	// interleaving.
+	if _, err := w.next.Write(append([]byte(w.format.render(w.proc)), line...)); err != nil {
+		return 0, err
+	}
+	return len(line), nil
+}
+
+// rateLimit counts the output lines of a child over one-second windows.
+type rateLimit struct {
+	mu      sync.Mutex
+	name    string
+	limit   int
+	window  time.Time
+	count   int
+	dropped int
+}
+
+// allow reports whether one more line fits in the current window. When a new
+// window starts, lines dropped in the previous one are reported to w.
+func (r *rateLimit) allow(w io.Writer) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := time.Now(); now.Sub(r.window) >= time.Second {
+		r.reportLocked(w)
+		r.window = now
+		r.count = 0
+	}
+	if r.count >= r.limit {
+		r.dropped++
+		return false
+	}
+	r.count++
+	return true
+}
+
+// report writes a notice about the lines dropped so far, if any.
+func (r *rateLimit) report(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reportLocked(w)
+}
+
+func (r *rateLimit) reportLocked(w io.Writer) {
+	if r.dropped > 0 {
+		fmt.Fprintf(w, "multirun: output suppressed, %d lines of %s over %d lines per second dropped\n", r.dropped, r.name, r.limit)
+		r.dropped = 0
+	}
+}
+
+// rateWriter forwards lines as long as the rate limit of their child allows.
+type rateWriter struct {
+	rate *rateLimit
+	next io.Writer
+}
+
+func (w *rateWriter) Write(line []byte) (int, error) {
+	if w.rate.allow(w.next) {
+		return w.next.Write(line)
+	}
+	return len(line), nil
+}
+
+// tailBuffer keeps the last lines written by a child.
+type tailBuffer struct {
+	mu    sync.Mutex
+	size  int
+	lines []string
+}
+
+func (t *tailBuffer) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.lines) == t.size {
+		t.lines = append(t.lines[:0], t.lines[1:]...)
+	}
+	t.lines = append(t.lines, line)
+}
+
+// contents returns a copy of the lines kept.
+func (t *tailBuffer) contents() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.lines...)
+}
+
+// readyWriter marks the subprocess ready once a line matches its
+// -ready-pattern, before forwarding every line.
+type readyWriter struct {
+	re   *regexp.Regexp
+	proc *subprocess
+	next io.Writer
+}
+
+func (w *readyWriter) Write(line []byte) (int, error) {
+	if w.re.Match(line) {
+		w.proc.readyOnce.Do(func() { close(w.proc.ready) })
+	}
+	return w.next.Write(line)
+}
+
+// tailWriter records each line in a tailBuffer before forwarding it.
+type tailWriter struct {
+	tail *tailBuffer
+	next io.Writer
+}
+
+func (w *tailWriter) Write(line []byte) (int, error) {
+	w.tail.add(strings.TrimSuffix(string(line), "\n"))
+	return w.next.Write(line)
+}
+
+// outputActivity counts the output lines of a subprocess and records when
+// the last one was written. It is updated by the goroutines copying the
+// output and read by the event loop.
+type outputActivity struct {
+	lines atomic.Int64
+	last  atomic.Int64 // in Unix nanoseconds
+}
+
+// snapshot returns the number of lines and the time of the last one.
+func (a *outputActivity) snapshot() (lines int64, last time.Time) {
+	return a.lines.Load(), time.Unix(0, a.last.Load())
+}
+
+// activityWriter records each line in an outputActivity before forwarding
+// it.
+type activityWriter struct {
+	activity *outputActivity
+	next     io.Writer
+}
+
+func (w *activityWriter) Write(line []byte) (int, error) {
+	w.activity.last.Store(time.Now().UnixNano())
+	w.activity.lines.Add(1)
+	return w.next.Write(line)
+}
+
+// syslogWriter sends each line to syslog before forwarding it.
+type syslogWriter struct {
+	log  *syslog.Writer
+	next io.Writer
+}
+
+func (w *syslogWriter) Write(line []byte) (int, error) {
+	// A syslog outage must not block or fail the output of the child.
+	w.log.Write(line)
+	return w.next.Write(line)
+}
+
+// syslogFacilities maps the facility names accepted by -syslog to their
+// values.
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// syslogSeverities maps the severity names accepted by -syslog to their
+// values.
+var syslogSeverities = map[string]syslog.Priority{
+	"emerg": syslog.LOG_EMERG, "alert": syslog.LOG_ALERT, "crit": syslog.LOG_CRIT,
+	"err": syslog.LOG_ERR, "warning": syslog.LOG_WARNING, "notice": syslog.LOG_NOTICE,
+	"info": syslog.LOG_INFO, "debug": syslog.LOG_DEBUG,
+}
+
+// parseSyslog parses a FACILITY[.SEVERITY] -syslog value into the priorities
+// of the stdout and stderr lines. Without a severity, stdout lines are sent
+// as info and stderr lines as err.
+func parseSyslog(spec string) (stdout, stderr syslog.Priority, err error) {
+	facilityName, severityName, hasSeverity := strings.Cut(spec, ".")
+	facility, ok := syslogFacilities[facilityName]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown facility %q", facilityName)
+	}
+	if !hasSeverity {
+		return facility | syslog.LOG_INFO, facility | syslog.LOG_ERR, nil
+	}
+	severity, ok := syslogSeverities[severityName]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown severity %q", severityName)
+	}
+	return facility | severity, facility | severity, nil
+}
+
+// perCommand is a repeatable flag of the form NAME=VALUE that attaches a
+// setting to the command called NAME.
+type perCommand map[string]string
+
+func (p perCommand) String() string {
+	pairs := make([]string, 0, len(p))
+	for name, value := range p {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (p perCommand) Set(value string) error {
+	name, setting, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected NAME=VALUE, got %q", value)
+	}
+	p[name] = setting
+	return nil
+}
+
+// commandNames derives a short, unique name for each command from the base
+// name of its executable. Repeated names get a numeric suffix, so that
+// "sleep 1" "sleep 2" are called "sleep" and "sleep-2".
+func commandNames(commands []string) []string {
+	names := make([]string, len(commands))
+	taken := make(map[string]bool)
+	for i, command := range commands {
+		base := "command"
+		if fields := strings.Fields(command); len(fields) > 0 {
+			base = filepath.Base(fields[0])
+		}
+		name := base
+		for n := 2; taken[name]; n++ {
+			name = fmt.Sprintf("%s-%d", base, n)
+		}
+		taken[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+// interpreter is the program that runs the code of a command given with
+// -interpreter, and the option that precedes the code.
+type interpreter struct {
+	program string
+	option  string
+}
+
+// shellScript returns the script that sh runs for the named command: the
+// command, through exec so that it replaces the shell, or its -interpreter
+// with the command as code. exec.Cmd offers no hook between fork and exec, so
+// the -umask, the -rlimit and the -nice are set by the shell beforehand.
+func (app *multirun) shellScript(name, command string) string {
+	script := "exec " + command
+	if interp, ok := app.interpreters[name]; ok {
+		script = fmt.Sprintf("exec %s %s %s", shellQuote(interp.program), shellQuote(interp.option), shellQuote(command))
+	}
+	// stdbuf sets the buffering up through LD_PRELOAD, which the inner
+	// shell passes on to the command.
+	if app.stdbuf {
+		script = "exec stdbuf -oL -eL sh -c " + shellQuote(script)
+	}
+	// nice adds to the niceness of multirun, which the children inherit.
+	if nice, ok := app.niceness[name]; ok {
+		script = fmt.Sprintf("exec nice -n %d sh -c %s", nice-ownNiceness(), shellQuote(script))
+	}
+	if umask, ok := app.umasks[name]; ok {
+		script = fmt.Sprintf("umask %04o; %s", umask, script)
+	}
+	// A limit that cannot be set, e.g. a hard limit raised without root,
+	// stops the command with the exit code of a command that cannot run.
+	for _, limit := range app.rlimits[name] {
+		script = limit.command() + " || exit 126; " + script
+	}
+	// systemd-run moves itself to a new scope, then executes the command
+	// in place, which keeps the pid and the process group.
+	if app.systemdScope {
+		script = fmt.Sprintf("exec systemd-run --scope --quiet --collect --description=%s -- sh -c %s",
+			shellQuote("multirun: "+name), shellQuote(script))
+	}
+	return script
+}
+
+// ownNiceness returns the niceness of multirun. The getpriority system call
+// returns 20 minus the niceness, so that it is never negative.
+func ownNiceness() int {
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	if err != nil {
+		return 0
+	}
+	return 20 - prio
+}
+
+// shellQuote quotes s for sh, within single quotes.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// systemdAvailable reports whether systemd manages the host and systemd-run
+// is installed, as -systemd-scope requires.
+func systemdAvailable() bool {
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		return false
+	}
+	_, err := exec.LookPath("systemd-run")
+	return err == nil
+}
+
+// graceOf returns how long a shutdown waits before killing the named command:
+// its -command-grace, or else -grace.
+func (app *multirun) graceOf(name string) time.Duration {
+	if grace, ok := app.graces[name]; ok {
+		return grace
+	}
+	return app.grace
+}
+
+// isEssential reports whether the exit of the named command must stop the
+// others. Commands are essential unless told otherwise, by -essential or by
+// being left out of -critical. With -leader, only the leader is.
+func (app *multirun) isEssential(name string) bool {
+	if app.leader != "" && name == app.leader {
+		return true
+	}
+	if essential, ok := app.essential[name]; ok {
+		return essential
+	}
+	if app.critical != nil {
+		return app.critical[name]
+	}
+	return app.leader == ""
+}
+
+// checkCommandNames ensures every per-command setting refers to one of the
+// given command names.
+func (app *multirun) checkCommandNames(names []string) error {
+	known := make(map[string]bool, len(names))
+	for _, name := range names {
+		known[name] = true
+	}
+	settings := []struct {
+		flag  string
+		names iter.Seq[string]
+	}{
+		{"-stop-priority", maps.Keys(app.stopPriority)},
+		{"-user", maps.Keys(app.credentials)},
+		{"-nice", maps.Keys(app.niceness)},
+		{"-umask", maps.Keys(app.umasks)},
+		{"-rlimit", maps.Keys(app.rlimits)},
+		{"-cpus", maps.Keys(app.cpus)},
+		{"-command-grace", maps.Keys(app.graces)},
+		{"-shutdown-ready-file", maps.Keys(app.readyToDie)},
+		{"-restart-delay", maps.Keys(app.delays)},
+		{"-interpreter", maps.Keys(app.interpreters)},
+		{"-restart-on", maps.Keys(app.restartCodes)},
+		{"-ready-pattern", maps.Keys(app.patterns)},
+		{"-essential", maps.Keys(app.essential)},
+		{"-critical", maps.Keys(app.critical)},
+		{"-leader", func(yield func(string) bool) {
+			if app.leader != "" {
+				yield(app.leader)
+			}
+		}},
+		{"-forking", maps.Keys(app.forking)},
+		{"-map-signal", maps.Keys(app.signalMaps)},
+		{"-exit-meaning", maps.Keys(app.exitMeanings)},
+		{"-watch", func(yield func(string) bool) {
+			for _, watch := range app.watches {
+				if !yield(watch.name) {
+					return
+				}
+			}
+		}},
+	}
+	for _, setting := range settings {
+		for name := range setting.names {
+			if !known[name] {
+				return fmt.Errorf("%s: no command named %q", setting.flag, name)
+			}
+		}
+	}
+	if app.stdinTarget != "" && !known[app.stdinTarget] {
+		return fmt.Errorf("-stdin: no command named %q", app.stdinTarget)
+	}
+	return nil
+}
+
+// rlimitResource is a resource accepted by -rlimit: its RLIMIT_* value, and
+// the option of ulimit that sets it, with the unit of its values.
+type rlimitResource struct {
+	resource int
+	option   byte
+	unit     uint64
+}
+
+// rlimitResources maps the resource names accepted by -rlimit to their
+// resources. The options and units are the same in the ulimit of dash,
+// busybox and bash run as sh. nproc is left out: its option is -p in the
+// first two, and -u in bash, where -p is the pipe size.
+var rlimitResources = map[string]rlimitResource{
+	"as":      {syscall.RLIMIT_AS, 'v', 1024},
+	"core":    {syscall.RLIMIT_CORE, 'c', 512},
+	"cpu":     {syscall.RLIMIT_CPU, 't', 1},
+	"data":    {syscall.RLIMIT_DATA, 'd', 1024},
+	"fsize":   {syscall.RLIMIT_FSIZE, 'f', 512},
+	"nofile":  {syscall.RLIMIT_NOFILE, 'n', 1},
+	"stack":   {syscall.RLIMIT_STACK, 's', 1024},
+	"memlock": {8, 'l', 1024}, // RLIMIT_MEMLOCK, not exported by the syscall package.
+}
+
+// rlimit is a resource limit to apply to a child, along with the limit of
+// multirun that the child starts with.
+type rlimit struct {
+	rlimitResource
+	name    string
+	limit   syscall.Rlimit
+	current syscall.Rlimit
+}
+
+// command returns the ulimit commands that set the limit, which fail if
+// either of them does. The soft limit can never be above the hard one, which
+// decides which of them is set first.
+func (r rlimit) command() string {
+	soft := fmt.Sprintf("ulimit -S -%c %s", r.option, r.value(r.limit.Cur))
+	if r.limit.Max == r.current.Max {
+		return soft
+	}
+	hard := fmt.Sprintf("ulimit -H -%c %s", r.option, r.value(r.limit.Max))
+	if r.limit.Max < r.current.Cur {
+		return soft + " && " + hard
+	}
+	return hard + " && " + soft
+}
+
+// value formats a limit for ulimit, in the unit of the resource.
+func (r rlimit) value(limit uint64) string {
+	if limit == ^uint64(0) {
+		return "unlimited"
+	}
+	return strconv.FormatUint(limit/r.unit, 10)
+}
+
+// cpuSet is a cpu_set_t, the CPU mask of sched_setaffinity, with room for
+// CPU_SETSIZE CPUs.
+type cpuSet [1024 / 64]uint64
+
+func (s *cpuSet) set(cpu int)      { s[cpu/64] |= 1 << (cpu % 64) }
+func (s *cpuSet) has(cpu int) bool { return s[cpu/64]&(1<<(cpu%64)) != 0 }
+
+// parseCPUList parses a list of CPUs such as "0-3,6", as in
+// /sys/devices/system/cpu/online, into a mask. Every CPU must be available
+// to multirun itself.
+func parseCPUList(spec string) (*cpuSet, error) {
+	var available cpuSet
+	if err := schedAffinity(syscall.SYS_SCHED_GETAFFINITY, 0, &available); err != nil {
+		return nil, err
+	}
+	set := new(cpuSet)
+	for _, item := range strings.Split(spec, ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		from, err := strconv.Atoi(first)
+		to := from
+		if err == nil && isRange {
+			to, err = strconv.Atoi(last)
+		}
+		if err != nil || from < 0 || to < from || to >= len(set)*64 {
+			return nil, fmt.Errorf("invalid CPU range %q", item)
+		}
+		for cpu := from; cpu <= to; cpu++ {
+			if !available.has(cpu) {
+				return nil, fmt.Errorf("CPU %d is not available", cpu)
+			}
+			set.set(cpu)
+		}
+	}
+	return set, nil
+}
+
+// schedAffinity gets or sets, depending on trap, the CPU affinity of the
+// process with the given pid, 0 standing for multirun itself.
+func schedAffinity(trap uintptr, pid int, set *cpuSet) error {
+	_, _, errno := syscall.RawSyscall(trap, uintptr(pid), unsafe.Sizeof(*set), uintptr(unsafe.Pointer(set)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// envKeyPattern matches the variable names accepted in an -env-file.
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseEnvFile reads a .env file made of KEY=VALUE lines and returns them in
+// the same form. Blank lines and lines starting with # are ignored, and an
+// optional "export " prefix is dropped. A value may be quoted: within single
+// quotes it is taken literally, within double quotes \n, \", \\ and \$ are
+// unescaped. Unquoted values end at " #", which starts a comment.
+func parseEnvFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var vars []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !envKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, i+1)
+		}
+		value, err = parseEnvValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+		vars = append(vars, key+"="+value)
+	}
+	return vars, nil
+}
+
+// parseEnvValue unquotes the value of an -env-file line.
+func parseEnvValue(value string) (string, error) {
+	if value == "" || (value[0] != '"' && value[0] != '\'') {
+		if i := strings.Index(value, " #"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+		return value, nil
+	}
+	quote := value[0]
+	var b strings.Builder
+	for i := 1; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == quote:
+			if rest := strings.TrimSpace(value[i+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+				return "", fmt.Errorf("unexpected text after the closing quote")
+			}
+			return b.String(), nil
+		case c == '\\' && quote == '"' && i+1 < len(value):
+			i++
+			switch value[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case '"', '\\', '$':
+				b.WriteByte(value[i])
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(value[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("missing closing quote")
+}
+
+// parseSignalMap parses a comma-separated list of FROM:TO signal pairs.
+func parseSignalMap(spec string) (map[syscall.Signal]syscall.Signal, error) {
+	signals := make(map[syscall.Signal]syscall.Signal)
+	for _, item := range strings.Split(spec, ",") {
+		fromName, toName, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("expected FROM:TO, got %q", item)
+		}
+		from, err := parseSignal(fromName)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseSignal(toName)
+		if err != nil {
+			return nil, err
+		}
+		// The kill at the end of -grace must stay a kill.
+		if from == syscall.SIGKILL {
+			return nil, fmt.Errorf("%s cannot be replaced", from)
+		}
+		signals[from] = to
+	}
+	return signals, nil
+}
+
+// parseExitCodes parses a comma-separated list of exit codes and ranges of
+// exit codes, such as 0,130,200-210.
+func parseExitCodes(spec string) (map[int]bool, error) {
+	codes := make(map[int]bool)
+	if spec == "" {
+		return codes, nil
+	}
+	parse := func(s string) (int, error) {
+		code, err := strconv.Atoi(s)
+		if err != nil || code < 0 || code > 255 {
+			return 0, fmt.Errorf("invalid exit code %q, expected 0 to 255", s)
+		}
+		return code, nil
+	}
+	for _, item := range strings.Split(spec, ",") {
+		lowText, highText, isRange := strings.Cut(item, "-")
+		low, err := parse(lowText)
+		if err != nil {
+			return nil, err
+		}
+		high := low
+		if isRange {
+			if high, err = parse(highText); err != nil {
+				return nil, err
+			}
+			if high < low {
+				return nil, fmt.Errorf("invalid range %q", item)
+			}
+		}
+		for code := low; code <= high; code++ {
+			codes[code] = true
+		}
+	}
+	return codes, nil
+}
+
+// parseExitMeanings parses a comma-separated list of CODE:TEXT descriptions.
+func parseExitMeanings(spec string) (map[int]string, error) {
+	meanings := make(map[int]string)
+	for _, item := range strings.Split(spec, ",") {
+		codeText, text, ok := strings.Cut(item, ":")
+		if !ok || text == "" {
+			return nil, fmt.Errorf("expected CODE:TEXT, got %q", item)
+		}
+		code, err := strconv.Atoi(codeText)
+		if err != nil || code < 0 || code > 255 {
+			return nil, fmt.Errorf("invalid exit code %q", codeText)
+		}
+		meanings[code] = text
+	}
+	return meanings, nil
+}
+
+// parseRlimits parses a comma-separated list of RESOURCE:SOFT[:HARD] limits.
+// Without a hard limit, the current hard limit of multirun is kept.
+func parseRlimits(spec string) ([]rlimit, error) {
+	var limits []rlimit
+	for _, item := range strings.Split(spec, ",") {
+		parts := strings.Split(item, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("expected RESOURCE:SOFT[:HARD], got %q", item)
+		}
+		resource, ok := rlimitResources[parts[0]]
+		if parts[0] == "nproc" {
+			return nil, fmt.Errorf("nproc is not supported, since sh has no portable way to set it")
+		} else if !ok {
+			return nil, fmt.Errorf("unknown resource %q", parts[0])
+		}
+		r := rlimit{rlimitResource: resource, name: parts[0]}
+		if err := syscall.Getrlimit(resource.resource, &r.current); err != nil {
+			return nil, err
+		}
+		r.limit = r.current
+		var err error
+		if r.limit.Cur, err = parseLimit(parts[1]); err != nil {
+			return nil, err
+		}
+		if len(parts) == 3 {
+			if r.limit.Max, err = parseLimit(parts[2]); err != nil {
+				return nil, err
+			}
+		}
+		if r.limit.Cur > r.limit.Max {
+			return nil, fmt.Errorf("soft limit of %s above its hard limit", parts[0])
+		}
+		for _, limit := range []uint64{r.limit.Cur, r.limit.Max} {
+			if limit != ^uint64(0) && limit%r.unit != 0 {
+				return nil, fmt.Errorf("limit of %s not a multiple of %d", parts[0], r.unit)
+			}
+		}
+		limits = append(limits, r)
+	}
+	return limits, nil
+}
+
+// parseLimit parses a limit value: a number with an optional K, M or G
+// binary suffix, or "unlimited".
+func parseLimit(value string) (uint64, error) {
+	if value == "unlimited" {
+		return ^uint64(0), nil // RLIM_INFINITY
+	}
+	digits, multiplier := value, uint64(1)
+	for suffix, m := range map[string]uint64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30} {
+		if rest, ok := strings.CutSuffix(value, suffix); ok {
+			digits, multiplier = rest, m
+		}
+	}
+	n, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit %q", value)
+	}
+	// The largest value stands for unlimited, so the limit must stay below it.
+	if n > (^uint64(0)-1)/multiplier {
+		return 0, fmt.Errorf("limit %q out of range", value)
+	}
+	return n * multiplier, nil
+}
+
+// resolveCredential turns a USER[:GROUP] specification, made of names or
+// numeric ids, into the credential a command runs with. Without a group, the
+// primary and supplementary groups of the user are used.
+func resolveCredential(spec string) (*syscall.Credential, error) {
+	userName, groupName, hasGroup := strings.Cut(spec, ":")
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return nil, fmt.Errorf("unknown user %q", userName)
+		}
+	}
+	uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+	cred := &syscall.Credential{Uid: uint32(uid)}
+
+	if hasGroup {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return nil, fmt.Errorf("unknown group %q", groupName)
+			}
+		}
+		gid, _ := strconv.ParseUint(g.Gid, 10, 32)
+		cred.Gid = uint32(gid)
+	} else {
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		cred.Gid = uint32(gid)
+		groups, _ := u.GroupIds()
+		for _, group := range groups {
+			if id, err := strconv.ParseUint(group, 10, 32); err == nil {
+				cred.Groups = append(cred.Groups, uint32(id))
+			}
+		}
+	}
+
+	if os.Geteuid() != 0 {
+		if int(cred.Uid) != os.Getuid() || int(cred.Gid) != os.Getgid() {
+			return nil, fmt.Errorf("running as %s requires multirun to run as root", spec)
+		}
+		// Without root, setgroups fails with EPERM: the command keeps the
+		// supplementary groups of multirun.
+		cred.Groups, cred.NoSetGroups = nil, true
+	}
+	return cred, nil
+}
+
+// signalNames maps the signal names accepted on the command line to their
+// values. Names are matched without their "SIG" prefix.
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"ILL":   syscall.SIGILL,
+	"TRAP":  syscall.SIGTRAP,
+	"ABRT":  syscall.SIGABRT,
+	"BUS":   syscall.SIGBUS,
+	"FPE":   syscall.SIGFPE,
+	"KILL":  syscall.SIGKILL,
+	"SEGV":  syscall.SIGSEGV,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"PIPE":  syscall.SIGPIPE,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"TTIN":  syscall.SIGTTIN,
+	"TTOU":  syscall.SIGTTOU,
+	"WINCH": syscall.SIGWINCH,
+	"XCPU":  syscall.SIGXCPU,
+	"XFSZ":  syscall.SIGXFSZ,
+	"SYS":   syscall.SIGSYS,
+}
+
+// parseSignal converts a signal name such as "SIGUSR1", "usr1" or a signal
+// number such as "10" into a syscall.Signal.
+func parseSignal(name string) (syscall.Signal, error) {
+	upper := strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	if sig, ok := signalNames[upper]; ok {
+		return sig, nil
+	}
+	if num, err := strconv.Atoi(name); err == nil && num > 0 && num < 65 {
+		return syscall.Signal(num), nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", name)
+}
+
+// exitStatus returns the exit code of a process that exited with err, as a
+// shell reports it: 128+N for a process killed by signal N, and -1 when it
+// is unknown. sig is the signal that killed the process, if any.
+func exitStatus(err error) (code int, sig syscall.Signal) {
+	if err == nil {
+		return 0, 0
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return -1, 0
+	}
+	ws, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return -1, 0
+	}
+	if ws.Signaled() {
+		return 128 + int(ws.Signal()), ws.Signal()
+	}
+	return ws.ExitStatus(), 0
+}
+
+// signalName returns the conventional name of sig, such as "SIGTERM".
+func signalName(sig syscall.Signal) string {
+	for name, value := range signalNames {
+		if value == sig {
+			return "SIG" + name
+		}
+	}
+	return sig.String()
+}
+
+// isNormalExit checks if a process exit error is considered "normal": an exit
+// with one of the -ok-codes, or a death by one of the -ok-signals.
+func (app *multirun) isNormalExit(err error) bool {
+	if err == nil {
+		return app.okCodes[0]
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return false
+	}
+
+	ws, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return false
+	}
+
+	if ws.Exited() {
+		return app.okCodes[ws.ExitStatus()]
+	}
+
+	if ws.Signaled() {
+		return app.okSignals[ws.Signal()]
+	}
+
+	return false
+}
+
+// dropBlankCommands removes the commands made only of whitespace, which
+// would otherwise run an empty shell that exits right away.
+func dropBlankCommands(commands []string, verbose bool) []string {
+	var kept []string
+	for i, command := range commands {
+		if strings.TrimSpace(command) == "" {
+			logf(verbose, "ignoring blank command at position %d", i+1)
+			continue
+		}
+		kept = append(kept, command)
+	}
+	return kept
+}
+
+// waitForPoll is how often -wait-for and -wait-for-file are checked.
+const waitForPoll = 250 * time.Millisecond
+
+// waitFor blocks until a TCP connection to addr, given as tcp://HOST:PORT,
+// succeeds and path exists, each being skipped if empty, or fails once
+// timeout expired.
+func (app *multirun) waitFor(addr, path string, timeout time.Duration) error {
+	var hostPort string
+	if addr != "" {
+		var ok bool
+		if hostPort, ok = strings.CutPrefix(addr, "tcp://"); !ok || hostPort == "" {
+			return fmt.Errorf("-wait-for: expected tcp://HOST:PORT, got %q", addr)
+		}
+	}
+	deadline := app.clock.Now().Add(timeout)
+	for hostPort != "" || path != "" {
+		if hostPort != "" {
+			if conn, err := net.DialTimeout("tcp", hostPort, waitForPoll); err == nil {
+				conn.Close()
+				logf(app.verbose, "%s is reachable", addr)
+				hostPort = ""
+			} else if app.clock.Now().After(deadline) {
+				return fmt.Errorf("-wait-for: %s still unreachable after %s: %v", addr, timeout, err)
+			}
+		}
+		if path != "" {
+			if _, err := os.Stat(path); err == nil {
+				logf(app.verbose, "%s exists", path)
+				path = ""
+			} else if app.clock.Now().After(deadline) {
+				return fmt.Errorf("-wait-for-file: %s still missing after %s", path, timeout)
+			}
+		}
+		if hostPort != "" || path != "" {
+			<-app.clock.After(waitForPoll)
+		}
+	}
+	return nil
+}
+
+// dedupeCommands keeps the first of the identical commands, and reports the
+// others on stderr.
+func dedupeCommands(commands []string) []string {
+	var kept []string
+	count := make(map[string]int)
+	for _, command := range commands {
+		if count[command] == 0 {
+			kept = append(kept, command)
+		}
+		count[command]++
+	}
+	for _, command := range kept {
+		if n := count[command]; n > 1 {
+			fmt.Fprintf(os.Stderr, "multirun: -dedupe: %q was given %d times, running it once\n", command, n)
+		}
+	}
+	return kept
+}
+
+// expandTemplate builds one command per value from a template in which each
+// %s or %d placeholder is replaced with the value, and %% stands for a
+// literal percent sign.
+func expandTemplate(template string, values []string) ([]string, error) {
+	var parts []string
+	var literal strings.Builder
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' {
+			literal.WriteByte(template[i])
+			continue
+		}
+		if i+1 == len(template) {
+			return nil, fmt.Errorf("trailing %% in %q", template)
+		}
+		i++
+		switch template[i] {
+		case '%':
+			literal.WriteByte('%')
+		case 's', 'd':
+			parts = append(parts, literal.String())
+			literal.Reset()
+		default:
+			return nil, fmt.Errorf("unknown placeholder %%%c in %q", template[i], template)
+		}
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("no %%s placeholder in %q", template)
+	}
+	parts = append(parts, literal.String())
+
+	commands := make([]string, len(values))
+	for i, value := range values {
+		commands[i] = strings.Join(parts, value)
+	}
+	return commands, nil
+}
+
+// isMultirunScript reports whether path is a file whose first line is a
+// shebang running multirun, as when the kernel runs such a script, rather
+// than a command to run.
+func isMultirunScript(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false
+	}
+	return strings.HasPrefix(line, "#!") && strings.Contains(line, "multirun")
+}
+
+// readScript reads the commands of a script, one per line. Blank lines and
+// lines starting with #, among them the shebang, are ignored.
+func readScript(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var commands []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		commands = append(commands, line)
+	}
+	return commands, nil
+}
+
+// scanShell walks a command following the quoting rules of sh: nothing is
+// escaped within single quotes, and a backslash escapes the next character
+// elsewhere. unquoted, if not nil, is called with each character that is
+// neither quoted nor escaped, nor a quote or backslash itself. It returns the
+// quote left open at the end, if any, where it started, and whether a
+// backslash escapes nothing.
+func scanShell(command string, unquoted func(r rune)) (inQuote rune, quoteStart int, escaped bool) {
+	for i, r := range command {
+		switch {
+		case escaped:
+			escaped = false
+		case inQuote == '\'':
+			if r == '\'' {
+				inQuote = 0
+			}
+		case r == '\\':
+			escaped = true
+		case inQuote == '"':
+			if r == '"' {
+				inQuote = 0
+			}
+		case r == '\'' || r == '"':
+			inQuote = r
+			quoteStart = i
+		case unquoted != nil:
+			unquoted(r)
+		}
+	}
+	return inQuote, quoteStart, escaped
+}
+
+// checkQuoting reports the quotes left open and the backslashes escaping
+// nothing in a command.
+func checkQuoting(command string) error {
+	inQuote, quoteStart, escaped := scanShell(command, nil)
+	switch {
+	case escaped:
+		return fmt.Errorf("trailing backslash")
+	case inQuote == '\'':
+		return fmt.Errorf("unterminated single quote at offset %d", quoteStart)
+	case inQuote == '"':
+		return fmt.Errorf("unterminated double quote at offset %d", quoteStart)
+	}
+	return nil
+}
+
+// isChained checks if a command string contains unquoted shell operators.
+func isChained(command string) bool {
+	chained := false
+	scanShell(command, func(r rune) {
+		if r == ';' || r == '|' || r == '&' {
+			chained = true
+		}
+	})
+	return chained
 }
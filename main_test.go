@@ -3,13 +3,26 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
 	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
+	"unsafe"
 )
 
 // TestMain allows us to intercept the test run.
@@ -55,6 +68,10 @@ func TestFailureCase(t *testing.T) {
 	if duration > 1*time.Second {
 		t.Errorf("Expected multirun to exit quickly, but it took %v", duration)
 	}
+
+	if !strings.Contains(string(output), "ended abnormally (stopped after sh failed)") {
+		t.Errorf("Expected the final message to tell the cascade apart.\nOutput:\n%s", string(output))
+	}
 }
 
 func TestSignalPropagation(t *testing.T) {
@@ -117,6 +134,12 @@ func TestChainedCommandsAreRejected(t *testing.T) {
 			name: "Single command with &",
 			args: []string{"sleep 1 &"},
 		},
+		{
+			// The backslash is literal within single quotes, so the quote
+			// ends before the &.
+			name: "Operator after a backslash in single quotes",
+			args: []string{`echo 'a\' & echo CHAINED`},
+		},
 		{
 			name: "Multiple commands with one chained",
 			args: []string{"echo hello", "sleep 1 && sleep 1"},
@@ -155,6 +178,45 @@ func TestChainedCommandsAreRejected(t *testing.T) {
 	}
 }
 
+func TestMalformedQuotingIsRejected(t *testing.T) {
+	testBin := os.Args[0]
+
+	testCases := []struct {
+		name    string
+		command string
+		want    string
+	}{
+		{name: "Unterminated double quote", command: `echo "hello`, want: "unterminated double quote at offset 5"},
+		{name: "Unterminated single quote", command: `echo 'hello`, want: "unterminated single quote at offset 5"},
+		{name: "Escaped closing quote", command: `echo "hello\"`, want: "unterminated double quote at offset 5"},
+		// A backslash does not escape anything within single quotes.
+		{name: "Backslash in single quotes", command: `echo 'it\'s'`, want: "unterminated single quote at offset 11"},
+		{name: "Trailing backslash", command: `echo hello\`, want: "trailing backslash"},
+		// The quote is closed, so the & that follows is a shell operator.
+		{name: "Operator after a backslash in single quotes", command: `echo 'a\' & echo CHAINED`, want: "chained commands are not supported"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := exec.Command(testBin, "echo ok", tc.command)
+			cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+			output, err := cmd.CombinedOutput()
+
+			exitErr, ok := err.(*exec.ExitError)
+			if !ok || exitErr.ExitCode() != 2 {
+				t.Fatalf("Expected exit code 2, but got: %v\nOutput:\n%s", err, output)
+			}
+			if !strings.Contains(string(output), tc.want) {
+				t.Errorf("Expected output to contain %q.\nOutput:\n%s", tc.want, output)
+			}
+			if strings.Contains(string(output), "ok\n") {
+				t.Errorf("Expected no command to be started.\nOutput:\n%s", output)
+			}
+		})
+	}
+}
+
 func TestCommandsWithSpecialCharsInArgsAreAccepted(t *testing.T) {
 	testBin := os.Args[0]
 
@@ -213,3 +275,3358 @@ func TestCommandsWithSpecialCharsInArgsAreAccepted(t *testing.T) {
 		})
 	}
 }
+
+func TestOkCodesAndSignals(t *testing.T) {
+	testBin := os.Args[0]
+
+	testCases := []struct {
+		name     string
+		args     []string
+		wantCode int
+	}{
+		{name: "Exit code in a range", args: []string{"-ok-codes=0,2-4", `sh -c "exit 3"`}, wantCode: 0},
+		{name: "Exit code out of the ranges", args: []string{"-ok-codes=0,2-4", `sh -c "exit 5"`}, wantCode: 1},
+		{name: "Zero left out", args: []string{"-ok-codes=1", "true"}, wantCode: 1},
+		{name: "Extra signal", args: []string{"-ok-signals=INT,TERM,HUP", `sh -c 'kill -HUP $$'`}, wantCode: 0},
+		{name: "Default signals", args: []string{`sh -c 'kill -HUP $$'`}, wantCode: 1},
+		{name: "No signal", args: []string{"-ok-signals=", `sh -c 'kill -TERM $$'`}, wantCode: 1},
+		{name: "Invalid code", args: []string{"-ok-codes=0,256", "true"}, wantCode: 2},
+		{name: "Reversed range", args: []string{"-ok-codes=4-2", "true"}, wantCode: 2},
+		{name: "Invalid signal", args: []string{"-ok-signals=NOPE", "true"}, wantCode: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := exec.Command(testBin, tc.args...)
+			cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+			output, err := cmd.CombinedOutput()
+
+			code := 0
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				code = exitErr.ExitCode()
+			} else if err != nil {
+				t.Fatalf("Failed to run multirun: %v", err)
+			}
+			if code != tc.wantCode {
+				t.Errorf("Expected exit code %d, got %d.\nOutput:\n%s", tc.wantCode, code, output)
+			}
+		})
+	}
+}
+
+func TestTickSignalIsRelayed(t *testing.T) {
+	testBin := os.Args[0]
+
+	// The child exits cleanly as soon as it receives the scheduled SIGUSR1.
+	cmd := exec.Command(testBin, "-tick-signal=SIGUSR1", "-tick-interval=100ms",
+		`sh -c 'trap "echo tick; exit 0" USR1; while true; do sleep 0.05; done'`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", string(output))
+	}
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v", err)
+	}
+
+	if !strings.Contains(string(output), "tick") {
+		t.Errorf("Expected the child to receive the scheduled signal.\nOutput:\n%s", string(output))
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	testCases := []struct {
+		name    string
+		want    syscall.Signal
+		wantErr bool
+	}{
+		{name: "SIGUSR1", want: syscall.SIGUSR1},
+		{name: "usr2", want: syscall.SIGUSR2},
+		{name: "TERM", want: syscall.SIGTERM},
+		{name: "9", want: syscall.SIGKILL},
+		{name: "SIGNOPE", wantErr: true},
+		{name: "0", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseSignal(tc.name)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error for %q, but got %v", tc.name, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error for %q: %v", tc.name, err)
+			}
+			if got != tc.want {
+				t.Errorf("Expected %v, but got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCommandNames(t *testing.T) {
+	got := commandNames([]string{"sleep 1", "/usr/bin/sleep 2", "php-fpm -F", "  ", "sleep-2"})
+	want := []string{"sleep", "sleep-2", "php-fpm", "command", "sleep-2-2"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Expected names %v, but got %v", want, got)
+	}
+}
+
+func TestStopPriority(t *testing.T) {
+	testBin := os.Args[0]
+
+	// The first command ("sh") has a higher priority, so it must only be
+	// stopped once the second one ("sh-2") is done with its slow cleanup.
+	cmd := exec.Command(testBin, "-stop-priority=sh=1",
+		`sh -c 'trap "echo sidecar-stopped; exit 0" TERM; while true; do sleep 0.05; done'`,
+		`sh -c 'trap "sleep 0.3; echo main-stopped; exit 0" TERM; while true; do sleep 0.05; done'`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Failed to send SIGTERM to multirun: %v", err)
+	}
+	waitErr := cmd.Wait()
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", output.String())
+	}
+
+	if waitErr != nil {
+		t.Errorf("Expected a nil error after graceful shutdown, but got: %v", waitErr)
+	}
+
+	mainStopped := strings.Index(output.String(), "main-stopped")
+	sidecarStopped := strings.Index(output.String(), "sidecar-stopped")
+	if mainStopped < 0 || sidecarStopped < 0 || sidecarStopped < mainStopped {
+		t.Errorf("Expected main to stop before the sidecar.\nOutput:\n%s", output.String())
+	}
+}
+
+func TestStopPriorityUnknownName(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-stop-priority=nope=1", "sleep 1")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 2 {
+		t.Fatalf("Expected exit code 2, but got: %v", err)
+	}
+	if !strings.Contains(string(output), `no command named "nope"`) {
+		t.Errorf("Expected an unknown name error.\nOutput:\n%s", string(output))
+	}
+}
+
+func TestResourceUsageIsReported(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-v", "true")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", string(output))
+	}
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v", err)
+	}
+
+	if !strings.Contains(string(output), "exited normally (user ") || !strings.Contains(string(output), "KiB)") {
+		t.Errorf("Expected the exit log to contain resource usage.\nOutput:\n%s", string(output))
+	}
+}
+
+func TestQuietDiscardsChildOutput(t *testing.T) {
+	testBin := os.Args[0]
+
+	// The first command outlives the failing one, so that its clean exit
+	// cannot cascade first.
+	cmd := exec.Command(testBin, "-quiet", `sh -c "echo hidden-output; sleep 5"`, `sh -c "echo hidden-error >&2; exit 3"`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", string(output))
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("Expected exit code 1, but got: %v", err)
+	}
+	if strings.Contains(string(output), "hidden") {
+		t.Errorf("Expected child output to be discarded.\nOutput:\n%s", string(output))
+	}
+	if !strings.Contains(string(output), "ended abnormally") {
+		t.Errorf("Expected the failure to still be reported.\nOutput:\n%s", string(output))
+	}
+}
+
+func TestQuietAndVerboseAreExclusive(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-quiet", "-v", "true")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 2 {
+		t.Fatalf("Expected exit code 2, but got: %v", err)
+	}
+	if !strings.Contains(string(output), "mutually exclusive") {
+		t.Errorf("Expected a clear error.\nOutput:\n%s", string(output))
+	}
+}
+
+func TestGrepFiltersChildOutput(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-grep=^keep",
+		`sh -c 'echo keep-1; echo drop; echo keep-2; printf keep-partial'`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", string(output))
+	}
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v", err)
+	}
+	for _, want := range []string{"keep-1\n", "keep-2\n", "keep-partial"} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("Expected output to contain %q.\nOutput:\n%s", want, string(output))
+		}
+	}
+	if strings.Contains(string(output), "drop") {
+		t.Errorf("Expected non-matching lines to be dropped.\nOutput:\n%s", string(output))
+	}
+}
+
+func TestGrepRejectsInvalidPattern(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-grep=(", "true")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 2 {
+		t.Fatalf("Expected exit code 2, but got: %v", err)
+	}
+	if !strings.Contains(string(output), "multirun: -grep:") {
+		t.Errorf("Expected an invalid pattern error.\nOutput:\n%s", string(output))
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := &lineWriter{next: writerFunc(func(p []byte) (int, error) {
+		lines = append(lines, string(p))
+		return len(p), nil
+	})}
+
+	w.Write([]byte("a\nb"))
+	w.Write([]byte("c\n\nd"))
+	w.Flush()
+
+	want := []string{"a\n", "bc\n", "\n", "d\n"}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected lines %q, but got %q", want, lines)
+	}
+}
+
+// writerFunc adapts a function to the io.Writer interface.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestMaxOutputRate(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-max-output-rate=5", "seq 1 100")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", string(output))
+	}
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v", err)
+	}
+	if !strings.HasPrefix(string(output), "1\n2\n3\n4\n5\n") || strings.Contains(string(output), "\n6\n") {
+		t.Errorf("Expected only the first 5 lines to be shown.\nOutput:\n%s", string(output))
+	}
+	if !strings.Contains(string(output), "95 lines of seq") {
+		t.Errorf("Expected a notice about the suppressed lines.\nOutput:\n%s", string(output))
+	}
+}
+
+// controlCommand sends one command to a control socket and returns its reply,
+// up to and including the final "ok" or "error" line.
+func controlCommand(t *testing.T, socket, command string) string {
+	t.Helper()
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to connect to the control socket: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, command)
+
+	var reply strings.Builder
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		reply.WriteString(line + "\n")
+		if line == "ok" || strings.HasPrefix(line, "error: ") {
+			break
+		}
+	}
+	return reply.String()
+}
+
+// waitForFile polls until path exists or the timeout expires.
+func waitForFile(t *testing.T, path string, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", path)
+}
+
+func TestControlSocket(t *testing.T) {
+	testBin := os.Args[0]
+	socket := filepath.Join(t.TempDir(), "multirun.sock")
+
+	cmd := exec.Command(testBin, "-control-socket="+socket, "sleep 5", "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	waitForFile(t, socket, 2*time.Second)
+
+	list := controlCommand(t, socket, "list")
+	if !strings.Contains(list, "sleep\t") || !strings.Contains(list, "sleep-2\t") || !strings.HasSuffix(list, "ok\n") {
+		t.Errorf("Unexpected reply to list:\n%s", list)
+	}
+	if status := controlCommand(t, socket, "status"); !strings.HasPrefix(status, `[{"pid":`) || !strings.HasSuffix(status, "]\nok\n") {
+		t.Errorf("Unexpected reply to status:\n%s", status)
+	}
+
+	if reply := controlCommand(t, socket, "signal nope TERM"); !strings.HasPrefix(reply, "error:") {
+		t.Errorf("Expected an error when signaling an unknown command, got:\n%s", reply)
+	}
+	if reply := controlCommand(t, socket, "frobnicate"); !strings.HasPrefix(reply, "error:") {
+		t.Errorf("Expected an error for an unknown command, got:\n%s", reply)
+	}
+	if reply := controlCommand(t, socket, "stop"); reply != "ok\n" {
+		t.Errorf("Unexpected reply to stop:\n%s", reply)
+	}
+
+	waitErr := cmd.Wait()
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", output.String())
+	}
+
+	if waitErr != nil {
+		t.Errorf("Expected a nil error after a stop command, but got: %v", waitErr)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected the control socket to be removed on exit")
+	}
+}
+
+func TestSend(t *testing.T) {
+	testBin := os.Args[0]
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "multirun.sock")
+	// The list of a command named errorlog is not an error.
+	errorlog := filepath.Join(dir, "errorlog")
+	if err := os.WriteFile(errorlog, []byte("#!/bin/sh\nexec sleep 5\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The trap tells when web got the signal, sent to it alone.
+	web := `sh -c 'trap "echo web got HUP" HUP; while true; do sleep 0.05; done'`
+	cmd := exec.Command(testBin, "-control-socket="+socket, web, "sleep 5", errorlog)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	defer cmd.Process.Kill()
+	waitForFile(t, socket, 2*time.Second)
+
+	send := func(command string) (string, error) {
+		c := exec.Command(testBin, "-control-socket="+socket, "-send="+command)
+		c.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+		out, err := c.CombinedOutput()
+		return string(out), err
+	}
+
+	if out, err := send("list"); err != nil || !strings.Contains(out, "sleep\t") || !strings.Contains(out, "errorlog\t") || strings.Contains(out, "ok\n") {
+		t.Errorf("Unexpected result of -send=list: %v\n%s", err, out)
+	}
+	if out, err := send("signal sh HUP"); err != nil || out != "" {
+		t.Errorf("Unexpected result of -send=\"signal sh HUP\": %v\n%s", err, out)
+	}
+	out, err := send("signal nope HUP")
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 || !strings.Contains(out, "no running command") {
+		t.Errorf("Expected exit code 1 for an unknown command, got: %v\n%s", err, out)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if _, err := send("stop"); err != nil {
+		t.Errorf("Unexpected error of -send=stop: %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("Expected multirun to stop cleanly, got: %v\nOutput:\n%s", err, output.String())
+	}
+	if !strings.Contains(output.String(), "web got HUP") {
+		t.Errorf("Expected web to receive SIGHUP.\nOutput:\n%s", output.String())
+	}
+
+	if _, err := send("list"); err == nil {
+		t.Errorf("Expected -send to fail once multirun is gone")
+	}
+}
+
+func TestControlSocketRestart(t *testing.T) {
+	testBin := os.Args[0]
+	socket := filepath.Join(t.TempDir(), "multirun.sock")
+
+	cmd := exec.Command(testBin, "-control-socket="+socket, "sleep 5", "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	waitForFile(t, socket, 2*time.Second)
+
+	before := controlCommand(t, socket, "list")
+	reply := controlCommand(t, socket, "restart sleep-2")
+	if !strings.HasPrefix(reply, "sleep-2\t") || !strings.HasSuffix(reply, "\nok\n") {
+		t.Errorf("Unexpected reply to restart:\n%s", reply)
+	}
+	after := controlCommand(t, socket, "list")
+	if strings.Count(after, "\tup\t") != 2 || after == before {
+		t.Errorf("Expected both commands to run, sleep-2 with a new pid.\nBefore:\n%s\nAfter:\n%s", before, after)
+	}
+	if reply := controlCommand(t, socket, "restart nope"); !strings.HasPrefix(reply, "error:") {
+		t.Errorf("Expected an error when restarting an unknown command, got:\n%s", reply)
+	}
+	controlCommand(t, socket, "stop")
+
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("Expected a nil error after a stop command, but got: %v\nOutput:\n%s", err, output.String())
+	}
+}
+
+func TestReadyPattern(t *testing.T) {
+	testBin := os.Args[0]
+
+	// The second command checks the first one is listening before it
+	// printed anything itself.
+	dir := t.TempDir()
+	first := fmt.Sprintf(`sh -c 'sleep 0.3; touch %s/listening; echo "Listening on 8080"; sleep 5'`, dir)
+	second := fmt.Sprintf(`sh -c 'ls %s/listening'`, dir)
+	cmd := exec.Command(testBin, "-ready-pattern=sh=Listening on [0-9]+", first, second)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Errorf("Expected the second command to start once the first was ready, but got: %v\nOutput:\n%s", err, output)
+	}
+
+	// A command that never prints the line stops everything.
+	cmd = exec.Command(testBin, "-ready-pattern=sleep=ready", "-ready-timeout=300ms", "sleep 5", "echo started")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err = cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("Expected exit code 1, but got: %v", err)
+	}
+	if !strings.Contains(string(output), `sleep did not print a line matching "ready" within 300ms`) || strings.Contains(string(output), "started") {
+		t.Errorf("Expected the timeout to be reported and the next command not to start.\nOutput:\n%s", output)
+	}
+}
+
+func TestRestartOn(t *testing.T) {
+	testBin := os.Args[0]
+	marker := filepath.Join(t.TempDir(), "failed-once")
+
+	// The command fails temporarily once, then succeeds.
+	flaky := fmt.Sprintf(`sh -c 'if [ -e %[1]s ]; then exit 0; fi; touch %[1]s; exit 75'`, marker)
+	cmd := exec.Command(testBin, "-restart-on=sh=75", flaky)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Errorf("Expected the command to succeed once restarted, but got: %v\nOutput:\n%s", err, output)
+	}
+	if !strings.Contains(string(output), "sh exited with exit code 75, restarting it") {
+		t.Errorf("Expected the restart to be reported.\nOutput:\n%s", output)
+	}
+
+	cmd = exec.Command(testBin, "-restart-on=sh=64-78", "-max-restarts=2", `sh -c "echo run; exit 78"`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err = cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("Expected exit code 1, but got: %v", err)
+	}
+	if n := strings.Count(string(output), "run\n"); n != 3 || !strings.Contains(string(output), "not restarting it after 2 restarts") {
+		t.Errorf("Expected the command to run 3 times, got %d.\nOutput:\n%s", n, output)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	testBin := os.Args[0]
+	socket := filepath.Join(t.TempDir(), "multirun.sock")
+
+	// Once drained, the failing command is neither restarted nor stops the
+	// other one, which runs to completion.
+	cmd := exec.Command(testBin, "-control-socket="+socket, "-restart-on=sh=3",
+		`sh -c "sleep 0.3; echo failing; exit 3"`, `sleep 1`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	waitForFile(t, socket, 2*time.Second)
+
+	if reply := controlCommand(t, socket, "drain"); reply != "ok\n" {
+		t.Errorf("Unexpected reply to drain: %q", reply)
+	}
+	if reply := controlCommand(t, socket, "restart sleep"); !strings.HasPrefix(reply, "error") {
+		t.Errorf("Expected restart to be refused while draining, got: %q", reply)
+	}
+
+	err := cmd.Wait()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("Expected exit code 1, but got: %v\nOutput:\n%s", err, output.String())
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Expected sleep to run to completion, but multirun exited after %v", elapsed)
+	}
+	if n := strings.Count(output.String(), "failing\n"); n != 1 {
+		t.Errorf("Expected the failing command to run once, got %d.\nOutput:\n%s", n, output.String())
+	}
+}
+
+func TestRestartDelay(t *testing.T) {
+	testBin := os.Args[0]
+	socket := filepath.Join(t.TempDir(), "multirun.sock")
+
+	cmd := exec.Command(testBin, "-control-socket="+socket, "-restart-delay=sleep-2=500ms", "sleep 5", "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	waitForFile(t, socket, 2*time.Second)
+
+	start := time.Now()
+	reply := controlCommand(t, socket, "restart sleep-2")
+	if !strings.HasSuffix(reply, "\nok\n") {
+		t.Errorf("Unexpected reply to restart:\n%s", reply)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("Expected sleep-2 to be started again after 500ms, but it took %v", elapsed)
+	}
+	start = time.Now()
+	if reply := controlCommand(t, socket, "restart sleep"); !strings.HasSuffix(reply, "\nok\n") {
+		t.Errorf("Unexpected reply to restart:\n%s", reply)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Expected sleep to be started again right away, but it took %v", elapsed)
+	}
+	controlCommand(t, socket, "stop")
+
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("Expected a nil error after a stop command, but got: %v\nOutput:\n%s", err, output.String())
+	}
+}
+
+func TestRestartDuringRestartDelay(t *testing.T) {
+	testBin := os.Args[0]
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "multirun.sock")
+	// sh fails on its first run only, and is started again after 500ms.
+	marker := filepath.Join(dir, "ran")
+	flaky := fmt.Sprintf(`sh -c "test -e %s || { touch %s; sleep 0.1; exit 3; }; sleep 5"`, marker, marker)
+
+	cmd := exec.Command(testBin, "-control-socket="+socket, "-restart-on=sh=3", "-restart-delay=sh=500ms", flaky)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	waitForFile(t, socket, 2*time.Second)
+	time.Sleep(300 * time.Millisecond)
+
+	// The restart requested meanwhile waits for the pending one.
+	reply := controlCommand(t, socket, "restart sh")
+	if !strings.HasSuffix(reply, "\nok\n") {
+		t.Errorf("Unexpected reply to restart:\n%s", reply)
+	}
+	// Past the delay, a second launch would show.
+	time.Sleep(500 * time.Millisecond)
+	list := controlCommand(t, socket, "list")
+	if n := strings.Count(list, "sh\t"); n != 1 {
+		t.Errorf("Expected sh to run once, got:\n%s", list)
+	}
+	controlCommand(t, socket, "stop")
+
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("Expected a nil error after a stop command, but got: %v\nOutput:\n%s", err, output.String())
+	}
+}
+
+func TestTrackOutput(t *testing.T) {
+	testBin := os.Args[0]
+	socket := filepath.Join(t.TempDir(), "multirun.sock")
+
+	cmd := exec.Command(testBin, "-track-output", "-control-socket="+socket,
+		`sh -c "echo one; echo two >&2; sleep 5"`, "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Signal(syscall.SIGTERM)
+	waitForFile(t, socket, 2*time.Second)
+	time.Sleep(200 * time.Millisecond)
+
+	reply := controlCommand(t, socket, "status")
+	var statuses []struct {
+		Name         string     `json:"name"`
+		OutputLines  *int64     `json:"outputLines"`
+		LastOutputAt *time.Time `json:"lastOutputAt"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSuffix(reply, "ok\n")), &statuses); err != nil {
+		t.Fatalf("Invalid status: %v\n%s", err, reply)
+	}
+	for _, status := range statuses {
+		switch status.Name {
+		case "sh":
+			if status.OutputLines == nil || *status.OutputLines != 2 || status.LastOutputAt == nil {
+				t.Errorf("Expected 2 lines of output for sh in %s", reply)
+			}
+		case "sleep":
+			if status.OutputLines == nil || *status.OutputLines != 0 || status.LastOutputAt != nil {
+				t.Errorf("Expected no output for sleep in %s", reply)
+			}
+		}
+	}
+}
+
+func TestUpgradeAdoptsChildren(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-v", "-timing", "sleep 5", "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if err := cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatalf("Failed to send SIGUSR2 to multirun: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Failed to send SIGTERM to multirun: %v", err)
+	}
+	waitErr := cmd.Wait()
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", output.String())
+	}
+
+	if waitErr != nil {
+		t.Errorf("Expected a nil error after graceful shutdown, but got: %v", waitErr)
+	}
+	for _, want := range []string{"upgrading to", "adopted command \"sleep 5\" as sleep with pid", "as sleep-2 with pid"} {
+		if !strings.Contains(output.String(), want) {
+			t.Errorf("Expected output to contain %q.\nOutput:\n%s", want, output.String())
+		}
+	}
+	if strings.Count(output.String(), "launched command") != 2 {
+		t.Errorf("Expected the commands to be launched only once.\nOutput:\n%s", output.String())
+	}
+	// The run time of an adopted command counts from its launch, before the
+	// upgrade.
+	match := regexp.MustCompile(`sleep exited with SIGTERM after (\d+\.\d{3})s`).FindStringSubmatch(output.String())
+	if match == nil {
+		t.Fatalf("Expected the run time of sleep.\nOutput:\n%s", output.String())
+	}
+	if seconds, _ := strconv.ParseFloat(match[1], 64); seconds < 0.7 || seconds > 5 {
+		t.Errorf("Expected sleep to have run for about 0.8s, got %ss.\nOutput:\n%s", match[1], output.String())
+	}
+}
+
+func TestUpgradeRefusedWithFilteredOutput(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-grep=.", "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	cmd.Process.Signal(syscall.SIGUSR2)
+	time.Sleep(100 * time.Millisecond)
+	cmd.Process.Signal(syscall.SIGTERM)
+	waitErr := cmd.Wait()
+
+	if waitErr != nil {
+		t.Errorf("Expected a nil error after graceful shutdown, but got: %v", waitErr)
+	}
+	if !strings.Contains(output.String(), "multirun: upgrade failed") {
+		t.Errorf("Expected the upgrade to be refused.\nOutput:\n%s", output.String())
+	}
+}
+
+func TestLogOutput(t *testing.T) {
+	testBin := os.Args[0]
+
+	testCases := []struct {
+		name       string
+		args       []string
+		wantStdout bool
+	}{
+		{name: "Default is stderr", args: []string{"-v", "true"}},
+		{name: "Explicit stdout", args: []string{"-v", "-log-output=stdout", "true"}, wantStdout: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := exec.Command(testBin, tc.args...)
+			cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+			var stdout, stderr bytes.Buffer
+			cmd.Stdout = &stdout
+			cmd.Stderr = &stderr
+
+			if err := cmd.Run(); err != nil {
+				t.Fatalf("Expected multirun to exit cleanly, but got: %v", err)
+			}
+
+			logs, other := &stderr, &stdout
+			if tc.wantStdout {
+				logs, other = &stdout, &stderr
+			}
+			if !strings.Contains(logs.String(), "multirun: launched command") {
+				t.Errorf("Expected verbose messages on the chosen stream, got:\n%s", logs.String())
+			}
+			if other.Len() != 0 {
+				t.Errorf("Expected nothing on the other stream, got:\n%s", other.String())
+			}
+		})
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	testCases := []struct {
+		name     string
+		template string
+		values   []string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "One placeholder",
+			template: "server --port %d",
+			values:   []string{"8080", "8081"},
+			want:     []string{"server --port 8080", "server --port 8081"},
+		},
+		{
+			name:     "Several placeholders and a literal percent",
+			template: "run %s --log %s.log --cpu 50%%",
+			values:   []string{"a"},
+			want:     []string{"run a --log a.log --cpu 50%"},
+		},
+		{name: "No placeholder", template: "server", values: []string{"a"}, wantErr: true},
+		{name: "Unknown placeholder", template: "server %x", values: []string{"a"}, wantErr: true},
+		{name: "Trailing percent", template: "server %", values: []string{"a"}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := expandTemplate(tc.template, tc.values)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error, but got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if strings.Join(got, "|") != strings.Join(tc.want, "|") {
+				t.Errorf("Expected %q, but got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestChdir(t *testing.T) {
+	testBin := os.Args[0]
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "script.sh"), []byte("pwd\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(testBin, "-chdir="+dir, "./script.sh")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v\nOutput:\n%s", err, output)
+	}
+	if strings.TrimSpace(string(output)) != dir {
+		t.Errorf("Expected the command to run from %s, got:\n%s", dir, output)
+	}
+
+	cmd = exec.Command(testBin, "-chdir="+filepath.Join(dir, "missing"), "true")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err = cmd.CombinedOutput()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 3 || !strings.Contains(string(output), "-chdir: chdir ") {
+		t.Errorf("Expected exit code 3 and a clear error for a missing directory, got: %v\nOutput:\n%s", err, output)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-dedupe", `sh -c "echo ran"`, "sleep 0.1", `sh -c "echo ran"`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v\nOutput:\n%s", err, output)
+	}
+	if n := strings.Count(string(output), "ran\n"); n != 1 {
+		t.Errorf("Expected the duplicated command to run once, but it ran %d times.\nOutput:\n%s", n, output)
+	}
+	if !strings.Contains(string(output), `"sh -c \"echo ran\"" was given 2 times, running it once`) {
+		t.Errorf("Expected the merge to be reported.\nOutput:\n%s", output)
+	}
+}
+
+func TestReportAfter(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-report-after=200ms", "-keep-going", "sleep 0.5", "true")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Expected the overrunning command to be left alone, but got: %v\nOutput:\n%s", err, output)
+	}
+	if !regexp.MustCompile(`1 of 2 commands still running after 200ms: sleep \(pid \d+\)\n`).Match(output) {
+		t.Errorf("Expected sleep to be reported.\nOutput:\n%s", output)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-heartbeat=200ms", "sleep 0.5", "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v\nOutput:\n%s", err, output)
+	}
+	if n := strings.Count(string(output), "heartbeat: 2 of 2 processes up: sleep (up 0s), sleep-2 (up 0s)\n"); n != 2 {
+		t.Errorf("Expected 2 heartbeats, got %d.\nOutput:\n%s", n, output)
+	}
+	if strings.Contains(string(output), "heartbeat: 1 of 2") {
+		t.Errorf("Expected the heartbeat to stop with the shutdown.\nOutput:\n%s", output)
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	testBin := os.Args[0]
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ready := filepath.Join(t.TempDir(), "ready")
+
+	// The command only prints if it starts once the file exists.
+	cmd := exec.Command(testBin, "-wait-for=tcp://"+l.Addr().String(), "-wait-for-file="+ready,
+		"sh -c 'test -e "+ready+" && echo started'")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := os.WriteFile(ready, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v\nOutput:\n%s", err, output.String())
+	}
+	if output.String() != "started\n" {
+		t.Errorf("Expected the command to start once the file exists.\nOutput:\n%s", output.String())
+	}
+}
+
+func TestWaitForTimeout(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-wait-for-file=/nonexistent", "-wait-timeout=300ms", "echo started")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 3 {
+		t.Fatalf("Expected exit code 3, but got: %v\nOutput:\n%s", err, output)
+	}
+	if !strings.Contains(string(output), "-wait-for-file: /nonexistent still missing after 300ms") {
+		t.Errorf("Expected a clear error.\nOutput:\n%s", output)
+	}
+}
+
+func TestTemplateRunsOneCommandPerValue(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-template", `sh -c "echo value-%s; sleep 0.2"`, "a", "b", "c")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", string(output))
+	}
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v", err)
+	}
+	for _, want := range []string{"value-a", "value-b", "value-c"} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("Expected output to contain %q.\nOutput:\n%s", want, string(output))
+		}
+	}
+}
+
+func TestNoSubreaper(t *testing.T) {
+	testBin := os.Args[0]
+
+	testCases := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "Default", args: []string{"-v", "true"}, want: "successfully registered as subreaper"},
+		{name: "Disabled", args: []string{"-v", "-no-subreaper", "true"}, want: "not registering as subreaper"},
+		{name: "Required", args: []string{"-v", "-require-subreaper", "true"}, want: "successfully registered as subreaper"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := exec.Command(testBin, tc.args...)
+			cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+			output, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("Expected multirun to exit cleanly, but got: %v", err)
+			}
+			if !strings.Contains(string(output), tc.want) {
+				t.Errorf("Expected output to contain %q.\nOutput:\n%s", tc.want, string(output))
+			}
+		})
+	}
+}
+
+func TestNoSubreaperAndRequireSubreaperAreExclusive(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-no-subreaper", "-require-subreaper", "true")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 2 {
+		t.Fatalf("Expected exit code 2, but got: %v", err)
+	}
+	if !strings.Contains(string(output), "mutually exclusive") {
+		t.Errorf("Expected a clear error.\nOutput:\n%s", string(output))
+	}
+}
+
+func TestShutdownReachesEscapedDescendants(t *testing.T) {
+	testBin := os.Args[0]
+	pidFile := filepath.Join(t.TempDir(), "escaped.pid")
+
+	// setsid moves the background sleep out of the process group of its child.
+	cmd := exec.Command(testBin, `sh -c 'setsid sleep 30 & echo $! > `+pidFile+`; wait'`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	waitForFile(t, pidFile, 2*time.Second)
+	time.Sleep(100 * time.Millisecond)
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("Failed to read the escaped pid: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("Invalid escaped pid %q: %v", data, err)
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("Expected a nil error after graceful shutdown, but got: %v", err)
+	}
+
+	// The escaped process is either gone or a zombie waiting to be reaped.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil || strings.Contains(string(stat), ") Z ") {
+			return
+		}
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("Expected the escaped descendant %d to be stopped", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestInitModeKeepsRunning(t *testing.T) {
+	testBin := os.Args[0]
+
+	// The first command leaves an orphan behind, which multirun adopts as a
+	// subreaper and must reap once it exits.
+	cmd := exec.Command(testBin, "-v", "-init", `sh -c 'sh -c "sleep 0.1 &"; exit 3'`, "sleep 0.2")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	select {
+	case err := <-exited:
+		t.Fatalf("Expected multirun to keep running in init mode, but it exited: %v\nOutput:\n%s", err, output.String())
+	case <-time.After(600 * time.Millisecond):
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	err := <-exited
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", output.String())
+	}
+
+	// The first command failed, which is still reported in the exit code.
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("Expected exit code 1, but got: %v", err)
+	}
+	if !strings.Contains(output.String(), "reaped orphaned process") {
+		t.Errorf("Expected the orphan to be reaped.\nOutput:\n%s", output.String())
+	}
+}
+
+func TestOnlyBlankCommands(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "", "   ", "\t")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 4 {
+		t.Fatalf("Expected exit code 4, but got: %v", err)
+	}
+	if !strings.Contains(string(output), "multirun: no commands to run") {
+		t.Errorf("Expected a specific message.\nOutput:\n%s", string(output))
+	}
+}
+
+func TestChainedCommandPreventsAnyLaunch(t *testing.T) {
+	testBin := os.Args[0]
+	marker := filepath.Join(t.TempDir(), "launched")
+
+	cmd := exec.Command(testBin, "touch "+marker, "echo a && echo b")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	if err := cmd.Run(); err == nil {
+		t.Fatal("Expected multirun to exit with an error, but it succeeded.")
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("Expected no command to be launched when one is invalid")
+	}
+}
+
+func TestStartupFailureExitCode(t *testing.T) {
+	testBin := os.Args[0]
+	socket := filepath.Join(t.TempDir(), "missing", "multirun.sock")
+
+	cmd := exec.Command(testBin, "-control-socket="+socket, "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 3 {
+		t.Fatalf("Expected exit code 3, but got: %v\nOutput:\n%s", err, string(output))
+	}
+}
+
+func TestShellMissing(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1", "PATH="+t.TempDir())
+
+	output, err := cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 3 {
+		t.Errorf("Expected exit code 3, but got: %v\nOutput:\n%s", err, string(output))
+	}
+	if !strings.Contains(string(output), "sh was not found in PATH") {
+		t.Errorf("Expected the missing shell to be explained.\nOutput:\n%s", output)
+	}
+}
+
+func TestStderrFile(t *testing.T) {
+	testBin := os.Args[0]
+	stderrFile := filepath.Join(t.TempDir(), "stderr.log")
+
+	cmd := exec.Command(testBin, "-stderr-file="+stderrFile, `sh -c "echo to-stdout; echo to-stderr >&2"`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v", err)
+	}
+
+	logged, err := os.ReadFile(stderrFile)
+	if err != nil {
+		t.Fatalf("Failed to read the stderr file: %v", err)
+	}
+	if string(logged) != "to-stderr\n" {
+		t.Errorf("Expected the stderr file to contain only the child's stderr, got %q", logged)
+	}
+	if stdout.String() != "to-stdout\n" || stderr.Len() != 0 {
+		t.Errorf("Unexpected output: stdout %q, stderr %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestRunAsUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("switching users requires root")
+	}
+	if _, err := user.Lookup("nobody"); err != nil {
+		t.Skip("no nobody user on this system")
+	}
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-user=id=nobody", "id -un")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v\nOutput:\n%s", err, string(output))
+	}
+	if strings.TrimSpace(string(output)) != "nobody" {
+		t.Errorf("Expected the command to run as nobody, got:\n%s", string(output))
+	}
+}
+
+func TestRunAsSelfWithoutRoot(t *testing.T) {
+	testBin := os.Args[0]
+	var attr *syscall.SysProcAttr
+	name := ""
+	if os.Geteuid() == 0 {
+		// multirun runs as nobody, from a copy of the test binary that
+		// nobody can execute.
+		u, err := user.Lookup("nobody")
+		if err != nil {
+			t.Skip("no nobody user on this system")
+		}
+		uid, _ := strconv.Atoi(u.Uid)
+		gid, _ := strconv.Atoi(u.Gid)
+		attr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}}
+		name = u.Username
+
+		dir, err := os.MkdirTemp("", "multirun")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		data, err := os.ReadFile(testBin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testBin = filepath.Join(dir, "multirun.test")
+		if err := os.WriteFile(testBin, data, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		u, err := user.Current()
+		if err != nil {
+			t.Skip("no user for the current uid")
+		}
+		name = u.Username
+	}
+
+	cmd := exec.Command(testBin, "-user=id="+name, "id -un")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	cmd.SysProcAttr = attr
+	cmd.Dir = "/"
+
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v\nOutput:\n%s", err, string(output))
+	}
+	if strings.TrimSpace(string(output)) != name {
+		t.Errorf("Expected the command to run as %s, got:\n%s", name, string(output))
+	}
+}
+
+func TestRunAsUnknownUser(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-user=id=no-such-user-here", "id -un")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 3 {
+		t.Fatalf("Expected exit code 3, but got: %v", err)
+	}
+	if !strings.Contains(string(output), `unknown user "no-such-user-here"`) {
+		t.Errorf("Expected an unknown user error.\nOutput:\n%s", string(output))
+	}
+}
+
+func TestNice(t *testing.T) {
+	testBin := os.Args[0]
+
+	// nice prints the niceness it runs with. It does so as soon as it
+	// starts, so the niceness must be set before exec.
+	cmd := exec.Command(testBin, "-nice=nice=7", "nice")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v\nOutput:\n%s", err, string(output))
+	}
+	if strings.TrimSpace(string(output)) != "7" {
+		t.Errorf("Expected the command to run with niceness 7, got:\n%s", string(output))
+	}
+}
+
+func TestNiceOutOfRange(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-nice=nice=20", "nice")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 2 {
+		t.Fatalf("Expected exit code 2, but got: %v\nOutput:\n%s", err, string(output))
+	}
+}
+
+func TestUmask(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-umask=sh=027", `sh -c "umask"`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v\nOutput:\n%s", err, string(output))
+	}
+	if strings.TrimSpace(string(output)) != "0027" {
+		t.Errorf("Expected the command to run with umask 0027, got:\n%s", string(output))
+	}
+}
+
+func TestSystemdScopeWithoutSystemd(t *testing.T) {
+	if _, err := os.Stat("/run/systemd/system"); err == nil {
+		t.Skip("systemd is running, the commands would get real scopes")
+	}
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-systemd-scope", "echo hello")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v\nOutput:\n%s", err, string(output))
+	}
+	if !strings.Contains(string(output), "systemd is not available") {
+		t.Errorf("Expected a warning that systemd is not available, got:\n%s", string(output))
+	}
+	if !strings.Contains(string(output), "hello") {
+		t.Errorf("Expected the command to run without a scope, got:\n%s", string(output))
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	got := shellQuote("exec echo 'it''s'")
+	out, err := exec.Command("sh", "-c", "printf %s "+got).Output()
+	if err != nil {
+		t.Fatalf("Expected the quoted string to be valid sh: %v", err)
+	}
+	if string(out) != "exec echo 'it''s'" {
+		t.Errorf("Expected quoting to round-trip, got %q", out)
+	}
+}
+
+func TestShebangScript(t *testing.T) {
+	testBin, err := filepath.Abs(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Symlink(testBin, filepath.Join(dir, "multirun")); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "services")
+	content := "#!/usr/bin/env multirun\n# the services\nsh -c 'echo first; sleep 0.3'\n\nsh -c 'echo second; sleep 0.3'\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(script)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1", "PATH="+dir+":"+os.Getenv("PATH"))
+
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v\nOutput:\n%s", err, string(output))
+	}
+	if !strings.Contains(string(output), "first") || !strings.Contains(string(output), "second") {
+		t.Errorf("Expected both commands of the script to run, got:\n%s", string(output))
+	}
+}
+
+func TestScriptFlag(t *testing.T) {
+	testBin := os.Args[0]
+	script := filepath.Join(t.TempDir(), "services")
+	if err := os.WriteFile(script, []byte("sh -c 'echo first; sleep 0.3'\nsh -c 'echo second; sleep 0.3'\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(testBin, "-script", script)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v\nOutput:\n%s", err, string(output))
+	}
+	if !strings.Contains(string(output), "first") || !strings.Contains(string(output), "second") {
+		t.Errorf("Expected both commands of the script to run, got:\n%s", string(output))
+	}
+}
+
+func TestExitCodeDir(t *testing.T) {
+	testBin := os.Args[0]
+	dir := t.TempDir()
+
+	cmd := exec.Command(testBin, "-exitcode-dir="+dir, `sh -c "exit 3"`, "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	if output, err := cmd.CombinedOutput(); err == nil {
+		t.Fatalf("Expected multirun to fail, got success.\nOutput:\n%s", string(output))
+	}
+	for name, want := range map[string]string{"sh": "3\n", "sleep": "143 SIGTERM\n"} {
+		data, err := os.ReadFile(filepath.Join(dir, name+".exitcode"))
+		if err != nil {
+			t.Errorf("Expected an exit code file for %s: %v", name, err)
+		} else if string(data) != want {
+			t.Errorf("Expected %q in the exit code file of %s, got %q", want, name, data)
+		}
+	}
+}
+
+func TestStdbuf(t *testing.T) {
+	if _, err := exec.LookPath("stdbuf"); err != nil {
+		t.Skip("stdbuf is not installed")
+	}
+	testBin := os.Args[0]
+
+	// stdbuf tells the library it preloads how to buffer through the
+	// environment.
+	cmd := exec.Command(testBin, "-stdbuf", "-umask=sh=027", `sh -c 'echo "$_STDBUF_O$_STDBUF_E"; umask'`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v\nOutput:\n%s", err, string(output))
+	}
+	if strings.TrimSpace(string(output)) != "LL\n0027" {
+		t.Errorf("Expected the command to run line buffered, with its umask, got:\n%s", string(output))
+	}
+}
+
+func TestRlimit(t *testing.T) {
+	testBin := os.Args[0]
+
+	// The hard limit is lowered below the soft limit of multirun, which
+	// requires the soft limit to be set first.
+	cmd := exec.Command(testBin, "-rlimit=sh=nofile:64:128", `sh -c "ulimit -Sn; ulimit -Hn"`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v\nOutput:\n%s", err, string(output))
+	}
+	if strings.TrimSpace(string(output)) != "64\n128" {
+		t.Errorf("Expected the command to have 64 open files at most, and 128 hard, got:\n%s", string(output))
+	}
+}
+
+func TestRlimitNotApplied(t *testing.T) {
+	testBin := os.Args[0]
+
+	// Not even root can raise the open files above fs.nr_open.
+	cmd := exec.Command(testBin, "-exit-code-policy=first", "-rlimit=echo=nofile:64:unlimited", "echo ran")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 126 {
+		t.Errorf("Expected the command to fail with code 126, but got: %v\nOutput:\n%s", err, output)
+	}
+	if strings.Contains(string(output), "ran") {
+		t.Errorf("Expected the command not to run without its limit.\nOutput:\n%s", output)
+	}
+}
+
+func TestCPUAffinity(t *testing.T) {
+	testBin := os.Args[0]
+	var available cpuSet
+	if err := schedAffinity(syscall.SYS_SCHED_GETAFFINITY, 0, &available); err != nil {
+		t.Fatal(err)
+	}
+	cpu := 0
+	for !available.has(cpu) {
+		cpu++
+	}
+
+	cmd := exec.Command(testBin, fmt.Sprintf("-cpus=sh=%d", cpu),
+		`sh -c "sleep 0.1; grep Cpus_allowed_list /proc/self/status"`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v\nOutput:\n%s", err, string(output))
+	}
+	if fields := strings.Fields(string(output)); len(fields) != 2 || fields[1] != strconv.Itoa(cpu) {
+		t.Errorf("Expected the command to run on CPU %d only, got:\n%s", cpu, string(output))
+	}
+}
+
+func TestParseCPUList(t *testing.T) {
+	for _, spec := range []string{"", "a", "3-1", "-1", "0-", "1023-1024", "100000"} {
+		if _, err := parseCPUList(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestParseRlimits(t *testing.T) {
+	limits, err := parseRlimits("nofile:1024:4096,as:1G:unlimited")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(limits) != 2 ||
+		limits[0].limit != (syscall.Rlimit{Cur: 1024, Max: 4096}) ||
+		limits[1].limit != (syscall.Rlimit{Cur: 1 << 30, Max: ^uint64(0)}) {
+		t.Errorf("Unexpected limits: %+v", limits)
+	}
+
+	for _, spec := range []string{"nofile", "bogus:1", "nofile:lots", "nofile:10:5",
+		"nproc:10", "as:1KK", "as:1GM", "as:20000000000G", "nofile:18446744073709551615", "as:1000"} {
+		if _, err := parseRlimits(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestReadyBarrier(t *testing.T) {
+	testBin := os.Args[0]
+	readyFile := filepath.Join(t.TempDir(), "ready")
+
+	cmd := exec.Command(testBin, "-v", "-ready-file="+readyFile, "-on-ready=echo on-ready-ran", "sleep 0.3", "sleep 0.3")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", string(output))
+	}
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v", err)
+	}
+	for _, want := range []string{"all 2 processes ready", "on-ready-ran"} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("Expected output to contain %q.\nOutput:\n%s", want, string(output))
+		}
+	}
+	if _, err := os.Stat(readyFile); err != nil {
+		t.Errorf("Expected the ready file to be created: %v", err)
+	}
+}
+
+func TestGraceKillsSurvivors(t *testing.T) {
+	testBin := os.Args[0]
+
+	// The first command ignores SIGTERM and can only be killed.
+	cmd := exec.Command(testBin, "-grace=300ms",
+		`sh -c 'trap "" TERM; while true; do sleep 0.05; done'`, "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	cmd.Process.Signal(syscall.SIGTERM)
+	err := cmd.Wait()
+	duration := time.Since(start)
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", output.String())
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("Expected exit code 1 for a killed child, but got: %v", err)
+	}
+	if duration < 300*time.Millisecond || duration > 2*time.Second {
+		t.Errorf("Expected multirun to exit right after the grace period, but it took %v", duration)
+	}
+	if !strings.Contains(output.String(), "grace period of 300ms expired") {
+		t.Errorf("Expected the kill to be reported.\nOutput:\n%s", output.String())
+	}
+	if !strings.Contains(output.String(), "(stopped on SIGTERM, survivors killed after the 300ms grace period)") {
+		t.Errorf("Expected the final message to tell the kill apart.\nOutput:\n%s", output.String())
+	}
+	if strings.Contains(output.String(), "OOM killer") {
+		t.Errorf("Expected the SIGKILL sent by multirun not to be flagged.\nOutput:\n%s", output.String())
+	}
+}
+
+func TestCommandGrace(t *testing.T) {
+	testBin := os.Args[0]
+
+	// Both commands ignore SIGTERM, the first one is given less time.
+	ignore := `sh -c 'trap "" TERM; while true; do sleep 0.05; done'`
+	cmd := exec.Command(testBin, "-grace=1s", "-command-grace=sh=200ms", ignore, ignore)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	cmd.Process.Signal(syscall.SIGTERM)
+	cmd.Wait()
+	duration := time.Since(start)
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", output.String())
+	}
+
+	first := strings.Index(output.String(), "grace period of 200ms expired, killing sh (pid")
+	second := strings.Index(output.String(), "grace period of 1s expired, killing sh-2 (pid")
+	if first < 0 || second < first {
+		t.Errorf("Expected sh to be killed first, then sh-2.\nOutput:\n%s", output.String())
+	}
+	if duration < time.Second || duration > 3*time.Second {
+		t.Errorf("Expected multirun to exit after the longest grace period, but it took %v", duration)
+	}
+	if !strings.Contains(output.String(), "survivors killed after the 1s grace period") {
+		t.Errorf("Expected the final message to give the longest grace period.\nOutput:\n%s", output.String())
+	}
+}
+
+func TestForceKill(t *testing.T) {
+	testBin := os.Args[0]
+
+	// The first command ignores SIGTERM, which would block the shutdown.
+	ignore := `sh -c 'trap "" TERM; while true; do sleep 0.05; done'`
+	start := time.Now()
+	cmd := exec.Command(testBin, "-force-kill", ignore, `sh -c "sleep 0.2"`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+	duration := time.Since(start)
+
+	if err != nil {
+		t.Errorf("Expected the children killed by -force-kill to count as normal, but got: %v\nOutput:\n%s", err, output)
+	}
+	if duration > 2*time.Second {
+		t.Errorf("Expected the children to be killed right away, but multirun took %v", duration)
+	}
+	if strings.Contains(string(output), "OOM") {
+		t.Errorf("Expected no OOM warning for a SIGKILL sent by multirun.\nOutput:\n%s", output)
+	}
+}
+
+func TestShutdownReadyFile(t *testing.T) {
+	testBin := os.Args[0]
+	marker := filepath.Join(t.TempDir(), "done")
+	if err := os.WriteFile(marker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The command cleans up for 300ms on SIGTERM, then waits to be killed.
+	cleanup := fmt.Sprintf(`sh -c 'trap "sleep 0.3; touch %s" TERM; while true; do sleep 0.05; done'`, marker)
+	cmd := exec.Command(testBin, "-grace=5s", "-shutdown-ready-file=sh="+marker, cleanup)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := os.Stat(marker); err == nil {
+		t.Errorf("Expected the stale marker to be removed when the command started")
+	}
+
+	start := time.Now()
+	cmd.Process.Signal(syscall.SIGTERM)
+	cmd.Wait()
+	duration := time.Since(start)
+
+	if duration < 300*time.Millisecond || duration > 2*time.Second {
+		t.Errorf("Expected multirun to kill the command once it created the marker, but it took %v\nOutput:\n%s", duration, output.String())
+	}
+}
+
+func TestForking(t *testing.T) {
+	testBin := os.Args[0]
+
+	// The first command forks a daemon that fails later, and exits at once.
+	daemonize := `sh -c 'sh -c "sleep 0.5; exit 3" & exit 0'`
+	cmd := exec.Command(testBin, "-v", "-forking=sh", daemonize, "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	duration := time.Since(start)
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", output)
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("Expected exit code 1 for the failed daemon, but got: %v", err)
+	}
+	if duration < 500*time.Millisecond || duration > 3*time.Second {
+		t.Errorf("Expected multirun to wait for the daemon, but it took %v", duration)
+	}
+	if !strings.Contains(string(output), "daemonized, following pid") {
+		t.Errorf("Expected the daemon to be followed.\nOutput:\n%s", output)
+	}
+	if !strings.Contains(string(output), "(stopped after sh failed)") {
+		t.Errorf("Expected the exit of the daemon to stop the others.\nOutput:\n%s", output)
+	}
+}
+
+func TestWatchRestartsCommand(t *testing.T) {
+	testBin := os.Args[0]
+	dir := t.TempDir()
+
+	cmd := exec.Command(testBin, "-v", "-watch="+dir+":sh", `sh -c "echo started; sleep 5"`, "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	// Several quick changes are debounced into a single restart.
+	for i := range 3 {
+		if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte(strconv.Itoa(i)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(700 * time.Millisecond)
+	cmd.Process.Signal(syscall.SIGTERM)
+	err := cmd.Wait()
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", output.String())
+	}
+
+	if err != nil {
+		t.Errorf("Expected multirun to exit normally, but got: %v", err)
+	}
+	if n := strings.Count(output.String(), "started\n"); n != 2 {
+		t.Errorf("Expected sh to be started twice, but it was %d times.\nOutput:\n%s", n, output.String())
+	}
+	if !strings.Contains(output.String(), "restarted sh with pid") {
+		t.Errorf("Expected the restart to be logged.\nOutput:\n%s", output.String())
+	}
+}
+
+func TestOnFailure(t *testing.T) {
+	testBin := os.Args[0]
+	notice := filepath.Join(t.TempDir(), "notice")
+
+	hook := `echo "$MULTIRUN_FAILED_NAME $MULTIRUN_FAILED_EXIT_CODE $MULTIRUN_FAILED_DESCRIPTION" > ` + notice
+	cmd := exec.Command(testBin, "-on-failure="+hook, `sh -c "sleep 0.1; exit 3"`, "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	if output, err := cmd.CombinedOutput(); err == nil {
+		t.Fatalf("Expected multirun to fail.\nOutput:\n%s", output)
+	}
+
+	// multirun waits for the hook before exiting.
+	data, err := os.ReadFile(notice)
+	if err != nil {
+		t.Fatalf("Expected the hook to run: %v", err)
+	}
+	if got := strings.TrimSpace(string(data)); got != "sh 3 exit code 3" {
+		t.Errorf("Expected the hook to be told about sh, got %q", got)
+	}
+}
+
+func TestOnFailureTimeout(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-on-failure=sleep 10", "-on-failure-timeout=200ms", "false")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	start := time.Now()
+	output, _ := cmd.CombinedOutput()
+	duration := time.Since(start)
+
+	if duration < 200*time.Millisecond || duration > 3*time.Second {
+		t.Errorf("Expected multirun to wait for the hook until its timeout, but it took %v", duration)
+	}
+	if !strings.Contains(string(output), "on-failure hook still running after 200ms, killing it") {
+		t.Errorf("Expected the kill of the hook to be reported.\nOutput:\n%s", output)
+	}
+}
+
+func TestPrintPids(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-print-pids=stderr", "sleep 0.1", "sleep 0.1")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected one line per command, got:\n%s", stderr.String())
+	}
+	for i, name := range []string{"sleep", "sleep-2"} {
+		fields := strings.Split(lines[i], "\t")
+		if len(fields) != 3 || fields[1] != name || fields[2] != "sleep 0.1" {
+			t.Errorf("Unexpected line %q", lines[i])
+			continue
+		}
+		if _, err := strconv.Atoi(fields[0]); err != nil {
+			t.Errorf("Expected a pid in line %q", lines[i])
+		}
+	}
+}
+
+func TestNonEssentialExitDoesNotCascade(t *testing.T) {
+	testBin := os.Args[0]
+
+	start := time.Now()
+	cmd := exec.Command(testBin, "-essential=sh=false", `sh -c "exit 3"`, "sleep 0.5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+	duration := time.Since(start)
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", string(output))
+	}
+
+	if err != nil {
+		t.Errorf("Expected the failure of a non-essential command to be ignored, but got: %v", err)
+	}
+	if duration < 500*time.Millisecond {
+		t.Errorf("Expected the essential command to run to completion, but multirun exited after %v", duration)
+	}
+}
+
+func TestCriticalSet(t *testing.T) {
+	testBin := os.Args[0]
+
+	start := time.Now()
+	cmd := exec.Command(testBin, "-critical=sleep", `sh -c "exit 3"`, "sleep 0.5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+	duration := time.Since(start)
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", string(output))
+	}
+
+	if err != nil {
+		t.Errorf("Expected the failure of a command outside the critical set to be ignored, but got: %v", err)
+	}
+	if duration < 500*time.Millisecond {
+		t.Errorf("Expected the critical command to run to completion, but multirun exited after %v", duration)
+	}
+}
+
+func TestIsEssential(t *testing.T) {
+	app := newMultirun(false)
+	app.critical = map[string]bool{"web": true, "db": true}
+	app.essential["metrics"] = true
+	app.essential["db"] = false
+
+	for name, want := range map[string]bool{"web": true, "db": false, "metrics": true, "cron": false} {
+		if got := app.isEssential(name); got != want {
+			t.Errorf("isEssential(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestTailLinesOnFailure(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-quiet", "-tail-lines=2",
+		`sh -c "echo line-1 >&2; echo line-2 >&2; echo line-3 >&2; exit 1"`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", string(output))
+	}
+
+	if err == nil {
+		t.Fatal("Expected multirun to exit with an error, but it succeeded.")
+	}
+	want := "multirun: sh exited abnormally, last lines of its stderr:\nmultirun:   line-2\nmultirun:   line-3\n"
+	if !strings.Contains(string(output), want) {
+		t.Errorf("Expected output to contain %q.\nOutput:\n%s", want, string(output))
+	}
+	if strings.Contains(string(output), "line-1") {
+		t.Errorf("Expected only the last 2 lines to be kept.\nOutput:\n%s", string(output))
+	}
+}
+
+func TestPreStopSignal(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-pre-stop-signal=USR1", "-pre-stop-delay=300ms",
+		`sh -c 'trap "echo draining" USR1; trap "echo stopped; exit 0" TERM; while true; do sleep 0.05; done'`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	cmd.Process.Signal(syscall.SIGTERM)
+	err := cmd.Wait()
+	duration := time.Since(start)
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", output.String())
+	}
+
+	if err != nil {
+		t.Errorf("Expected a nil error after graceful shutdown, but got: %v", err)
+	}
+	draining := strings.Index(output.String(), "draining")
+	stopped := strings.Index(output.String(), "stopped")
+	if draining < 0 || stopped < draining {
+		t.Errorf("Expected the pre-stop signal before the stop signal.\nOutput:\n%s", output.String())
+	}
+	if duration < 300*time.Millisecond {
+		t.Errorf("Expected the stop signal to wait for the pre-stop delay, but multirun exited after %v", duration)
+	}
+}
+
+func TestContextCancelStopsAll(t *testing.T) {
+	app := newMultirun(false)
+	if err := app.startSubprocesses([]string{"sleep 5", "sleep 5"}); err != nil {
+		t.Fatalf("Failed to start subprocesses: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	hadErrors := app.handleEvents(ctx)
+	duration := time.Since(start)
+
+	if hadErrors {
+		t.Errorf("Expected a clean stop after the cancellation")
+	}
+	if duration > 2*time.Second {
+		t.Errorf("Expected the run to stop soon after the cancellation, but it took %v", duration)
+	}
+}
+
+// fakeProcess is a process that exits when told to, or when it receives
+// SIGTERM, unless it is stubborn, or SIGKILL.
+type fakeProcess struct {
+	pid      int
+	exit     chan error
+	signals  chan syscall.Signal
+	stubborn bool
+}
+
+func newFakeProcess(pid int) *fakeProcess {
+	return &fakeProcess{pid: pid, exit: make(chan error, 1), signals: make(chan syscall.Signal, 10)}
+}
+
+func (p *fakeProcess) Start() error            { return nil }
+func (p *fakeProcess) Pid() int                { return p.pid }
+func (p *fakeProcess) Wait() error             { return <-p.exit }
+func (p *fakeProcess) Rusage() *syscall.Rusage { return nil }
+
+func (p *fakeProcess) Signal(sig syscall.Signal) error {
+	p.signals <- sig
+	if sig == syscall.SIGTERM && !p.stubborn || sig == syscall.SIGKILL {
+		select {
+		case p.exit <- nil:
+		default:
+		}
+	}
+	return nil
+}
+
+func TestFailureCascadesWithFakeProcesses(t *testing.T) {
+	app := newMultirun(false)
+	// The fake processes have no descendants, and /proc lists those of the
+	// test instead.
+	scans := 0
+	app.descendants = func() []int {
+		scans++
+		return nil
+	}
+	fakes := map[string]*fakeProcess{}
+	app.newProcess = func(script string, attr *syscall.SysProcAttr, env []string, stdin io.Reader, stdout, stderr io.Writer) process {
+		p := newFakeProcess(-1000 - len(fakes))
+		fakes[strings.TrimPrefix(script, "exec ")] = p
+		return p
+	}
+	if err := app.startSubprocesses([]string{"failing", "server"}); err != nil {
+		t.Fatalf("Failed to start subprocesses: %v", err)
+	}
+	fakes["failing"].exit <- fmt.Errorf("exit status 1")
+
+	if !app.handleEvents(context.Background()) {
+		t.Errorf("Expected the failure to be reported")
+	}
+	select {
+	case sig := <-fakes["server"].signals:
+		if sig != syscall.SIGTERM {
+			t.Errorf("Expected server to receive SIGTERM, got %v", sig)
+		}
+	default:
+		t.Errorf("Expected server to be signaled")
+	}
+	if scans == 0 {
+		t.Errorf("Expected the shutdown to look for escaped descendants")
+	}
+}
+
+// fakeClock is a clock whose time only passes when advanced, firing the
+// timers that expire on the way.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer sends the time on c, or calls f, at the given time, and again
+// every period for tickers.
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	period  time.Duration
+	c       chan time.Time
+	f       func()
+	stopped bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	stopped := t.stopped
+	t.stopped = true
+	return !stopped
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) add(d time.Duration, period time.Duration, f func()) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), period: period, c: make(chan time.Time, 1), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time { return c.add(d, 0, nil).c }
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer { return c.add(d, 0, f) }
+
+func (c *fakeClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	t := c.add(d, d, nil)
+	return t.c, func() { t.Stop() }
+}
+
+// pending returns the number of timers not fired or stopped yet.
+func (c *fakeClock) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, t := range c.timers {
+		if !t.stopped {
+			n++
+		}
+	}
+	return n
+}
+
+// Advance moves the time forward by d and fires the timers expired by then.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		for !t.stopped && !t.at.After(c.now) {
+			if t.f != nil {
+				go t.f()
+			} else {
+				select {
+				case t.c <- t.at:
+				default:
+				}
+			}
+			if t.period == 0 {
+				t.stopped = true
+			} else {
+				t.at = t.at.Add(t.period)
+			}
+		}
+	}
+}
+
+// waitForTimers polls until the clock has n pending timers.
+func waitForTimers(t *testing.T, c *fakeClock, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for c.pending() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d timers", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGraceWithFakeClock(t *testing.T) {
+	app := newMultirun(false)
+	clock := newFakeClock()
+	app.clock = clock
+	app.grace = time.Hour
+	app.descendants = func() []int { return nil }
+	fakes := map[string]*fakeProcess{}
+	app.newProcess = func(script string, attr *syscall.SysProcAttr, env []string, stdin io.Reader, stdout, stderr io.Writer) process {
+		p := newFakeProcess(-1000 - len(fakes))
+		fakes[strings.TrimPrefix(script, "exec ")] = p
+		return p
+	}
+	if err := app.startSubprocesses([]string{"failing", "server"}); err != nil {
+		t.Fatalf("Failed to start subprocesses: %v", err)
+	}
+	fakes["server"].stubborn = true
+	fakes["failing"].exit <- fmt.Errorf("exit status 1")
+
+	done := make(chan bool)
+	go func() { done <- app.handleEvents(context.Background()) }()
+
+	// The server ignores SIGTERM, and is only killed once the hour of grace
+	// passed.
+	waitForTimers(t, clock, 1)
+	if sig := <-fakes["server"].signals; sig != syscall.SIGTERM {
+		t.Errorf("Expected server to receive SIGTERM first, got %v", sig)
+	}
+	clock.Advance(time.Hour - time.Second)
+	select {
+	case <-done:
+		t.Fatalf("Expected multirun to wait for the grace period")
+	case sig := <-fakes["server"].signals:
+		t.Fatalf("Expected no signal before the end of the grace period, got %v", sig)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected multirun to return once the server was killed")
+	}
+	if sig := <-fakes["server"].signals; sig != syscall.SIGKILL {
+		t.Errorf("Expected server to be killed, got %v", sig)
+	}
+	if app.killedAfter != time.Hour {
+		t.Errorf("Expected the kill to be recorded after an hour, got %v", app.killedAfter)
+	}
+}
+
+func TestPreStopDelayWithFakeClock(t *testing.T) {
+	app := newMultirun(false)
+	clock := newFakeClock()
+	app.clock = clock
+	app.grace = time.Second
+	app.preStop = syscall.SIGUSR1
+	app.preStopDelay = 5 * time.Second
+	app.descendants = func() []int { return nil }
+	fakes := map[string]*fakeProcess{}
+	app.newProcess = func(script string, attr *syscall.SysProcAttr, env []string, stdin io.Reader, stdout, stderr io.Writer) process {
+		p := newFakeProcess(-1000 - len(fakes))
+		fakes[strings.TrimPrefix(script, "exec ")] = p
+		return p
+	}
+	if err := app.startSubprocesses([]string{"failing", "server"}); err != nil {
+		t.Fatalf("Failed to start subprocesses: %v", err)
+	}
+	fakes["server"].stubborn = true
+	fakes["failing"].exit <- fmt.Errorf("exit status 1")
+
+	done := make(chan bool)
+	go func() { done <- app.handleEvents(context.Background()) }()
+
+	// The grace period, shorter than the pre-stop delay, only starts with
+	// the stop signal.
+	waitForTimers(t, clock, 1)
+	if sig := <-fakes["server"].signals; sig != syscall.SIGUSR1 {
+		t.Errorf("Expected server to receive SIGUSR1 first, got %v", sig)
+	}
+	clock.Advance(time.Second)
+	select {
+	case sig := <-fakes["server"].signals:
+		t.Fatalf("Expected no signal before the end of the pre-stop delay, got %v", sig)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clock.Advance(4 * time.Second)
+	if sig := <-fakes["server"].signals; sig != syscall.SIGTERM {
+		t.Errorf("Expected server to receive SIGTERM after the pre-stop delay, got %v", sig)
+	}
+	waitForTimers(t, clock, 1)
+	clock.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected multirun to return once the server was killed")
+	}
+	if sig := <-fakes["server"].signals; sig != syscall.SIGKILL {
+		t.Errorf("Expected server to be killed, got %v", sig)
+	}
+}
+
+func TestTimeoutsWithFakeClock(t *testing.T) {
+	app := newMultirun(false)
+	clock := newFakeClock()
+	app.clock = clock
+
+	// -wait-for-file gives up once its timeout passed on the clock.
+	done := make(chan error)
+	go func() { done <- app.waitFor("", filepath.Join(t.TempDir(), "never"), time.Second) }()
+	var err error
+	for polls := 0; err == nil; polls++ {
+		if polls > 10 {
+			t.Fatalf("Expected -wait-for-file to time out")
+		}
+		waitForTimers(t, clock, 1)
+		clock.Advance(waitForPoll)
+		select {
+		case err = <-done:
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if !strings.Contains(err.Error(), "still missing after 1s") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// The -on-failure-timeout kills a hook that outlives it.
+	start := time.Now()
+	app.runHook("on-failure", "sleep 5", nil, time.Hour)
+	waitForTimers(t, clock, 1)
+	clock.Advance(time.Hour)
+	app.hookWait.Wait()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the hook to be killed once the hour passed, but it took %v", elapsed)
+	}
+}
+
+func TestStdinEOFClosesChildStdin(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-v", "-stdin=cat", "-essential=cat=false", "cat", "sleep 0.5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	cmd.Stdin = strings.NewReader("hello from stdin\n")
+
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	duration := time.Since(start)
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", string(output))
+	}
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v", err)
+	}
+	if !strings.Contains(string(output), "hello from stdin") {
+		t.Errorf("Expected cat to echo its stdin.\nOutput:\n%s", string(output))
+	}
+	if !strings.Contains(string(output), "end of stdin") {
+		t.Errorf("Expected the end of stdin to be logged.\nOutput:\n%s", string(output))
+	}
+	if duration < 500*time.Millisecond {
+		t.Errorf("Expected the other command to keep running after cat exited, but multirun exited after %v", duration)
+	}
+}
+
+func TestStatusFile(t *testing.T) {
+	testBin := os.Args[0]
+	dir := t.TempDir()
+	statusFile := filepath.Join(dir, "status.json")
+	// sh-2 fails on its first run only, and keeps running once restarted.
+	marker := filepath.Join(dir, "ran")
+	flaky := fmt.Sprintf(`sh -c "test -e %s || { touch %s; exit 4; }; sleep 5"`, marker, marker)
+
+	cmd := exec.Command(testBin, "-status-file="+statusFile, "-essential=sh=false", "-restart-on=sh-2=4",
+		"sleep 5", "sh -c 'exit 3'", flaky)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Signal(syscall.SIGTERM)
+	time.Sleep(300 * time.Millisecond)
+
+	cmd.Process.Signal(syscall.SIGUSR1)
+	waitForFile(t, statusFile, 2*time.Second)
+
+	data, err := os.ReadFile(statusFile)
+	if err != nil {
+		t.Fatalf("Failed to read the status file: %v", err)
+	}
+	var statuses []struct {
+		Name         string `json:"name"`
+		Up           bool   `json:"up"`
+		LastExitCode *int   `json:"lastExitCode"`
+		Restarts     int    `json:"restarts"`
+		Usage        *struct {
+			MaxRSSKiB int64 `json:"maxRssKiB"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &statuses); err != nil {
+		t.Fatalf("Invalid status file: %v\n%s", err, data)
+	}
+	if len(statuses) != 3 {
+		t.Fatalf("Expected 3 entries, got %s", data)
+	}
+	for _, status := range statuses {
+		switch status.Name {
+		case "sleep":
+			if !status.Up || status.LastExitCode != nil || status.Usage != nil {
+				t.Errorf("Expected sleep to be up without exit code and usage, got %s", data)
+			}
+		case "sh":
+			if status.Up || status.LastExitCode == nil || *status.LastExitCode != 3 {
+				t.Errorf("Expected sh to have exited with 3, got %s", data)
+			}
+			if status.Usage == nil || status.Usage.MaxRSSKiB <= 0 {
+				t.Errorf("Expected the resource usage of sh, got %s", data)
+			}
+		case "sh-2":
+			if !status.Up || status.Restarts != 1 || status.LastExitCode == nil || *status.LastExitCode != 4 {
+				t.Errorf("Expected sh-2 to be up again after exiting with 4, got %s", data)
+			}
+		default:
+			t.Errorf("Unexpected entry %q in %s", status.Name, data)
+		}
+	}
+}
+
+func TestShutdownWaitFilePostponesKill(t *testing.T) {
+	testBin := os.Args[0]
+	waitFile := filepath.Join(t.TempDir(), "cleanup")
+	if err := os.WriteFile(waitFile, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(testBin, "-grace=300ms", "-shutdown-wait-file="+waitFile,
+		`sh -c 'trap "" TERM; while true; do sleep 0.05; done'`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	cmd.Process.Signal(syscall.SIGTERM)
+	time.AfterFunc(450*time.Millisecond, func() { os.Remove(waitFile) })
+	cmd.Wait()
+	duration := time.Since(start)
+
+	if testing.Verbose() {
+		t.Logf("multirun output:\n%s", output.String())
+	}
+
+	if duration < 450*time.Millisecond || duration > 2*time.Second {
+		t.Errorf("Expected the kill to wait for the removal of the file, but multirun exited after %v", duration)
+	}
+}
+
+func TestMapSignal(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-map-signal=sh=TERM:INT",
+		`sh -c 'trap "" TERM; trap "echo got INT; exit 0" INT; while true; do sleep 0.05; done'`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	cmd.Process.Signal(syscall.SIGTERM)
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected a nil error, but got: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("multirun did not exit: SIGTERM was not translated")
+	}
+	if !strings.Contains(output.String(), "got INT") {
+		t.Errorf("Expected the child to receive SIGINT.\nOutput:\n%s", output.String())
+	}
+}
+
+func TestParseSignalMap(t *testing.T) {
+	signals, err := parseSignalMap("TERM:INT,SIGHUP:usr1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if signals[syscall.SIGTERM] != syscall.SIGINT || signals[syscall.SIGHUP] != syscall.SIGUSR1 || len(signals) != 2 {
+		t.Errorf("Unexpected map: %v", signals)
+	}
+
+	for _, spec := range []string{"TERM", "TERM:NOPE", "KILL:TERM"} {
+		if _, err := parseSignalMap(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	testBin := os.Args[0]
+	report := filepath.Join(t.TempDir(), "report.json")
+
+	cmd := exec.Command(testBin, "-report="+report, `sh -c "sleep 0.2; exit 3"`, "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	if output, err := cmd.CombinedOutput(); err == nil {
+		t.Fatalf("Expected multirun to fail.\nOutput:\n%s", output)
+	}
+
+	data, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatalf("Failed to read the report: %v", err)
+	}
+	var entries []struct {
+		Name            string  `json:"name"`
+		ExitCode        int     `json:"exitCode"`
+		Signal          string  `json:"signal"`
+		DurationSeconds float64 `json:"durationSeconds"`
+		Usage           *struct {
+			MaxRSSKiB int64 `json:"maxRssKiB"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatalf("Invalid report: %v\n%s", err, data)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %s", data)
+	}
+	for _, entry := range entries {
+		if entry.Usage == nil || entry.Usage.MaxRSSKiB <= 0 {
+			t.Errorf("Expected the resource usage of %s in %s", entry.Name, data)
+		}
+		switch entry.Name {
+		case "sh":
+			if entry.ExitCode != 3 || entry.Signal != "" || entry.DurationSeconds < 0.2 {
+				t.Errorf("Unexpected entry for sh in %s", data)
+			}
+		case "sleep":
+			if entry.ExitCode != 128+int(syscall.SIGTERM) || entry.Signal != "SIGTERM" {
+				t.Errorf("Unexpected entry for sleep in %s", data)
+			}
+		default:
+			t.Errorf("Unexpected entry %q in %s", entry.Name, data)
+		}
+	}
+}
+
+func TestReportOnStartupFailure(t *testing.T) {
+	testBin := os.Args[0]
+	dir := t.TempDir()
+
+	// Nothing is started, but the report still tells so. An invalid command
+	// is reported before waiting.
+	for _, test := range []struct {
+		args []string
+		code int
+	}{
+		{[]string{"-wait-for-file=" + filepath.Join(dir, "never"), "-wait-timeout=100ms", "sleep 5"}, 3},
+		{[]string{"-control-socket=" + filepath.Join(dir, "missing", "multirun.sock"), "sleep 5"}, 3},
+		{[]string{"-wait-for-file=" + filepath.Join(dir, "never"), "-wait-timeout=1h", "echo a; echo b"}, 2},
+		{[]string{"-nice=typo=5", "sleep 5"}, 2},
+	} {
+		args := test.args
+		report := filepath.Join(dir, "report.json")
+		os.Remove(report)
+		cmd := exec.Command(testBin, append([]string{"-report=" + report}, args...)...)
+		cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+		output, err := cmd.CombinedOutput()
+
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || exitErr.ExitCode() != test.code {
+			t.Errorf("%v: expected exit code %d, but got: %v\nOutput:\n%s", args, test.code, err, output)
+		}
+		if data, err := os.ReadFile(report); err != nil || string(data) != "[]\n" {
+			t.Errorf("%v: expected an empty report, got %q (%v)", args, data, err)
+		}
+	}
+}
+
+func TestShowConfig(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-show-config=json", "-grace=1s", "-command-grace=sleep=3s",
+		"-nice=true=5", "-essential=true=false", "sleep 0.1", "true")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Expected multirun to run the commands afterwards, got %v.\nStderr:\n%s", err, stderr.String())
+	}
+
+	var entries []struct {
+		Name      string   `json:"name"`
+		Argv      []string `json:"argv"`
+		Grace     string   `json:"grace"`
+		Essential bool     `json:"essential"`
+		Nice      *int     `json:"nice"`
+	}
+	if err := json.Unmarshal(stderr.Bytes(), &entries); err != nil {
+		t.Fatalf("Invalid configuration: %v\n%s", err, stderr.String())
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %s", stderr.String())
+	}
+	sleep, yes := entries[0], entries[1]
+	if sleep.Name != "sleep" || sleep.Grace != "3s" || !sleep.Essential || sleep.Nice != nil ||
+		strings.Join(sleep.Argv, " ") != "sh -c exec sleep 0.1" {
+		t.Errorf("Unexpected entry for sleep in %s", stderr.String())
+	}
+	if yes.Name != "true" || yes.Grace != "1s" || yes.Essential || yes.Nice == nil || *yes.Nice != 5 {
+		t.Errorf("Unexpected entry for true in %s", stderr.String())
+	}
+}
+
+func TestExitMeaning(t *testing.T) {
+	testBin := os.Args[0]
+	report := filepath.Join(t.TempDir(), "report.json")
+
+	cmd := exec.Command(testBin, "-report="+report, "-exit-meaning=sh=1:failure,2:config error",
+		`sh -c "exit 2"`, "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("Expected multirun to fail.\nOutput:\n%s", output)
+	}
+	if !strings.Contains(string(output), "(stopped after sh failed with exit code 2: config error)") {
+		t.Errorf("Expected the final message to describe the exit code.\nOutput:\n%s", output)
+	}
+
+	data, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatalf("Failed to read the report: %v", err)
+	}
+	var entries []struct {
+		Name    string `json:"name"`
+		Meaning string `json:"meaning"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatalf("Invalid report: %v\n%s", err, data)
+	}
+	for _, entry := range entries {
+		if want := map[string]string{"sh": "config error"}[entry.Name]; entry.Meaning != want {
+			t.Errorf("Expected meaning %q for %s in %s", want, entry.Name, data)
+		}
+	}
+}
+
+func TestParseEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	content := `# database
+DB_HOST=localhost
+export DB_PORT = 5432
+PLAIN=a b # comment
+
+SINGLE='$HOME \n' # literal
+DOUBLE="line\nnext \"quoted\" \$HOME"
+EMPTY=
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	vars, err := parseEnvFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := []string{
+		"DB_HOST=localhost",
+		"DB_PORT=5432",
+		"PLAIN=a b",
+		"SINGLE=$HOME \\n",
+		"DOUBLE=line\nnext \"quoted\" $HOME",
+		"EMPTY=",
+	}
+	if strings.Join(vars, "|") != strings.Join(want, "|") {
+		t.Errorf("parseEnvFile() = %q, want %q", vars, want)
+	}
+
+	for _, line := range []string{"NOVALUE", "1KEY=x", `QUOTED="open`, `QUOTED='a'b`} {
+		if err := os.WriteFile(path, []byte(line+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseEnvFile(path); err == nil {
+			t.Errorf("Expected an error for %q", line)
+		}
+	}
+}
+
+func TestEnvFile(t *testing.T) {
+	testBin := os.Args[0]
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte("GREETING=\"hello from the env file\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(testBin, "-env-file="+path, `sh -c 'echo "$GREETING"'`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1", "GREETING=inherited")
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v\nOutput:\n%s", err, output)
+	}
+	if !strings.Contains(string(output), "hello from the env file") {
+		t.Errorf("Expected the env file to override the inherited environment.\nOutput:\n%s", output)
+	}
+}
+
+func TestStopSignalOverridesForwarding(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-stop-signal=HUP",
+		`sh -c 'trap "" INT TERM; trap "echo got HUP; exit 0" HUP; while true; do sleep 0.05; done'`, "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	cmd.Process.Signal(syscall.SIGINT)
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected children stopped by the stop signal to exit normally, but got: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		cmd.Process.Kill()
+		t.Fatalf("multirun did not exit: SIGINT was forwarded instead of SIGHUP")
+	}
+	if !strings.Contains(output.String(), "got HUP") {
+		t.Errorf("Expected the child to receive SIGHUP.\nOutput:\n%s", output.String())
+	}
+}
+
+func TestCgroup(t *testing.T) {
+	testBin := os.Args[0]
+
+	// A daemonized descendant survives the shutdown of its parent unless
+	// the cgroup is killed.
+	cmd := exec.Command(testBin, "-cgroup", `sh -c "setsid sh -c 'trap \"\" TERM; sleep 30' & exit 0"`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+
+	var fs syscall.Statfs_t
+	if syscall.Statfs(cgroupRoot, &fs) != nil || fs.Type != cgroup2SuperMagic {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || exitErr.ExitCode() != 3 || !strings.Contains(string(output), "-cgroup") {
+			t.Errorf("Expected exit code 3 without cgroup v2, but got: %v\nOutput:\n%s", err, output)
+		}
+		return
+	}
+	if err != nil {
+		t.Skipf("Cannot use a cgroup here: %v\nOutput:\n%s", err, output)
+	}
+	if out, _ := exec.Command("pgrep", "-f", "sleep 30").Output(); len(out) > 0 {
+		t.Errorf("Expected the descendant to be killed with the cgroup, found pids %s", out)
+	}
+}
+
+func TestParseSyslog(t *testing.T) {
+	stdout, stderr, err := parseSyslog("daemon")
+	if err != nil || stdout != syslog.LOG_DAEMON|syslog.LOG_INFO || stderr != syslog.LOG_DAEMON|syslog.LOG_ERR {
+		t.Errorf("parseSyslog(daemon) = %v, %v, %v", stdout, stderr, err)
+	}
+	stdout, stderr, err = parseSyslog("local3.warning")
+	if err != nil || stdout != syslog.LOG_LOCAL3|syslog.LOG_WARNING || stderr != stdout {
+		t.Errorf("parseSyslog(local3.warning) = %v, %v, %v", stdout, stderr, err)
+	}
+	for _, spec := range []string{"nope", "daemon.nope", "daemon."} {
+		if _, _, err := parseSyslog(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestSyslogUnavailable(t *testing.T) {
+	if _, err := os.Stat("/dev/log"); err == nil {
+		t.Skip("syslog is available")
+	}
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-syslog=daemon", "true")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 3 || !strings.Contains(string(output), "-syslog") {
+		t.Errorf("Expected exit code 3 and a clear error without syslog, but got: %v\nOutput:\n%s", err, output)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	testBin := os.Args[0]
+
+	testCases := []struct {
+		name     string
+		args     []string
+		cascades bool
+	}{
+		{name: "FailureDuringWarmup", args: []string{"-warmup=1s", `sh -c "exit 3"`, "sleep 0.5"}, cascades: false},
+		{name: "FailureAfterWarmup", args: []string{"-warmup=100ms", `sh -c "sleep 0.2; exit 3"`, "sleep 2"}, cascades: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := exec.Command(testBin, tc.args...)
+			cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+			start := time.Now()
+			output, err := cmd.CombinedOutput()
+			duration := time.Since(start)
+
+			exitErr, ok := err.(*exec.ExitError)
+			if !ok || exitErr.ExitCode() != 1 {
+				t.Errorf("Expected exit code 1 for the failure, but got: %v\nOutput:\n%s", err, output)
+			}
+			if cascaded := duration < 500*time.Millisecond; cascaded != tc.cascades {
+				t.Errorf("Expected cascade %v, but multirun exited after %v\nOutput:\n%s", tc.cascades, duration, output)
+			}
+		})
+	}
+}
+
+func TestLastOutputIsKept(t *testing.T) {
+	testBin := os.Args[0]
+
+	// The first command fails with an unterminated last line, the second
+	// one says goodbye when the cascade stops it.
+	for i := 0; i < 5; i++ {
+		cmd := exec.Command(testBin, "-prefix-format=[{name}] ",
+			`sh -c 'sleep 0.1; printf "last words"; exit 3'`,
+			`sh -c 'trap "echo goodbye; exit 0" TERM; while true; do sleep 0.05; done'`)
+		cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+		output, _ := cmd.CombinedOutput()
+
+		if !strings.Contains(string(output), "[sh] last words\n") || !strings.Contains(string(output), "[sh-2] goodbye\n") {
+			t.Fatalf("Expected the last output of both commands.\nOutput:\n%s", output)
+		}
+	}
+}
+
+func TestTiming(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-timing", "-keep-going", "sleep 0.3", `sh -c "exit 2"`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, _ := cmd.CombinedOutput()
+
+	// atLeast checks that the seconds matched by the first group of
+	// pattern are not below min.
+	atLeast := func(pattern string, min float64) {
+		t.Helper()
+		match := regexp.MustCompile(pattern).FindSubmatch(output)
+		if match == nil {
+			t.Errorf("Expected output matching %q.\nOutput:\n%s", pattern, output)
+			return
+		}
+		if seconds, _ := strconv.ParseFloat(string(match[1]), 64); seconds < min {
+			t.Errorf("Expected at least %vs, got %ss.\nOutput:\n%s", min, match[1], output)
+		}
+	}
+	atLeast(`multirun: sh exited with exit code 2 after (\d+\.\d{3})s\n`, 0)
+	atLeast(`multirun: sleep exited with exit code 0 after (\d+\.\d{3})s\n`, 0.3)
+	atLeast(`multirun: run times: .*\bsleep (\d+\.\d{3})s`, 0.3)
+	atLeast(`multirun: run times: .*\bsh (\d+\.\d{3})s`, 0)
+}
+
+func TestInterpreter(t *testing.T) {
+	testBin := os.Args[0]
+
+	// The code would be rejected as chained if it went to the shell. awk
+	// takes its program as its first operand, after --.
+	cmd := exec.Command(testBin, "-keep-going", "-exit-code-policy=highest", "-interpreter=echo=sh", "-interpreter=BEGIN=awk:--",
+		`echo a; echo "b" | tr b c`, `BEGIN { print "awk ran"; exit 4 }`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+
+	// The outputs of both commands may interleave.
+	lines := "\n" + string(output)
+	if !strings.Contains(lines, "\na\n") || !strings.Contains(lines, "\nc\n") {
+		t.Errorf("Expected the code to run through sh -c.\nOutput:\n%s", output)
+	}
+	if !strings.Contains(lines, "\nawk ran\n") {
+		t.Errorf("Expected the code to run through awk.\nOutput:\n%s", output)
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 4 || !strings.Contains(string(output), "BEGIN (exit code 4)") {
+		t.Errorf("Expected the exit code of awk to be passed on, but got: %v\nOutput:\n%s", err, output)
+	}
+
+	cmd = exec.Command(testBin, "-interpreter=nope=python3", "sleep 1")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err = cmd.CombinedOutput()
+
+	exitErr, ok = err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 2 || !strings.Contains(string(output), `-interpreter: no command named "nope"`) {
+		t.Errorf("Expected a usage error for an unknown name, but got: %v\nOutput:\n%s", err, output)
+	}
+}
+
+func TestExitIsNotEndOfOutput(t *testing.T) {
+	testBin := os.Args[0]
+
+	// A child closing its output early is still supervised until it exits.
+	start := time.Now()
+	cmd := exec.Command(testBin, "-prefix-format=[{name}] ", `sh -c 'echo closing; exec >&- 2>&-; sleep 0.5; exit 3'`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("Expected exit code 1, but got: %v\nOutput:\n%s", err, output)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("Expected multirun to wait for the child to exit, but it returned after %v", elapsed)
+	}
+	if !strings.Contains(string(output), "[sh] closing\n") {
+		t.Errorf("Expected the output before the close.\nOutput:\n%s", output)
+	}
+
+	// A descendant holding the output open does not hide the exit of the
+	// child.
+	start = time.Now()
+	cmd = exec.Command(testBin, "-prefix-format=[{name}] ", `sh -c 'sleep 5 & echo done'`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err = cmd.CombinedOutput()
+
+	if err != nil {
+		t.Errorf("Expected a normal exit, but got: %v\nOutput:\n%s", err, output)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected multirun to notice the exit of the child, but it returned after %v", elapsed)
+	}
+	if !strings.Contains(string(output), "[sh] done\n") {
+		t.Errorf("Expected the output of the child.\nOutput:\n%s", output)
+	}
+}
+
+func TestPrefixFormat(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-prefix-format=[{name}:{pid}] ", "echo hello")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v", err)
+	}
+	fields := strings.SplitN(strings.TrimSuffix(string(output), "\n"), " ", 2)
+	if len(fields) != 2 || !strings.HasPrefix(fields[0], "[echo:") || fields[1] != "hello" {
+		t.Fatalf("Expected a prefixed line.\nOutput:\n%s", output)
+	}
+	if _, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(fields[0], "[echo:"), "]")); err != nil {
+		t.Errorf("Expected the pid in the prefix.\nOutput:\n%s", output)
+	}
+}
+
+func TestParsePrefixFormat(t *testing.T) {
+	proc := &subprocess{name: "web", command: "web --port 80", process: newFakeProcess(42)}
+	format, err := parsePrefixFormat("{name}({pid}) {command}: ")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := format.render(proc); got != "web(42) web --port 80: " {
+		t.Errorf("render() = %q", got)
+	}
+
+	for _, spec := range []string{"{nope}", "[{name"} {
+		if _, err := parsePrefixFormat(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestPty(t *testing.T) {
+	testBin := os.Args[0]
+
+	testCases := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "WithPty", args: []string{"-pty"}, want: "terminal\nerror\n"},
+		{name: "WithoutPty", args: nil, want: "pipe\nerror\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			args := append(tc.args, `sh -c 'if [ -t 1 ]; then echo terminal; else echo pipe; fi; echo error >&2'`)
+			cmd := exec.Command(testBin, args...)
+			cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+
+			var output bytes.Buffer
+			cmd.Stdout = &output
+			cmd.Stderr = &output
+			if err := cmd.Run(); err != nil {
+				t.Fatalf("Expected multirun to exit cleanly, but got: %v", err)
+			}
+			if output.String() != tc.want {
+				t.Errorf("Expected %q, got %q", tc.want, output.String())
+			}
+		})
+	}
+}
+
+func TestTUI(t *testing.T) {
+	testBin := os.Args[0]
+
+	master, slave, err := openPty()
+	if err != nil {
+		t.Skipf("No pty available: %v", err)
+	}
+	defer master.Close()
+	defer slave.Close()
+
+	cmd := exec.Command(testBin, "-tui", `sh -c "echo hello; sleep 5"`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+
+	var mu sync.Mutex
+	var screen bytes.Buffer
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := master.Read(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			screen.Write(buf[:n])
+			mu.Unlock()
+		}
+	}()
+	contents := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return screen.String()
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for !strings.Contains(contents(), "1 of 1 up") || !strings.Contains(contents(), "hello") {
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			t.Fatalf("Timed out waiting for the table and the output.\nScreen:\n%q", contents())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// q stops everything as Ctrl-C does.
+	master.Write([]byte("q"))
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("Expected multirun to exit cleanly on q, but got: %v\nScreen:\n%q", err, contents())
+	}
+}
+
+func TestTUIWithoutTerminal(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-tui", "echo hello")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("Expected multirun to exit cleanly, but got: %v\nOutput:\n%s", err, output)
+	}
+	if !strings.Contains(string(output), "-tui: stdin or stdout is not a terminal, running without it") || !strings.Contains(string(output), "hello") {
+		t.Errorf("Expected the commands to run without the table.\nOutput:\n%s", output)
+	}
+}
+
+func TestJobControl(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-print-pids=stdout", "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Signal(syscall.SIGTERM)
+	defer cmd.Process.Signal(syscall.SIGCONT)
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, _ := strconv.Atoi(strings.Split(line, "\t")[0])
+	state := func(pid int) string {
+		data, _ := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))
+		return fields[0]
+	}
+	waitState := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for state(cmd.Process.Pid) != want || state(child) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected multirun and its child in state %s, got %s and %s", want, state(cmd.Process.Pid), state(child))
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	cmd.Process.Signal(syscall.SIGTSTP)
+	waitState("T")
+	cmd.Process.Signal(syscall.SIGCONT)
+	waitState("S")
+}
+
+func TestPtyKeptOpenByDescendant(t *testing.T) {
+	testBin := os.Args[0]
+
+	// The background sleep ignores the SIGHUP of the pty, and keeps it open
+	// after sh exited.
+	start := time.Now()
+	cmd := exec.Command(testBin, "-pty", `sh -c 'trap "" HUP; echo before; sleep 5 & exit 1'`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("Expected exit code 1, but got: %v\nOutput:\n%s", err, output)
+	}
+	if !strings.Contains(string(output), "before\n") {
+		t.Errorf("Expected the output written before the exit.\nOutput:\n%s", output)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the exit to be handled within a second of the pty, but it took %v", elapsed)
+	}
+}
+
+func TestPtyResize(t *testing.T) {
+	testBin := os.Args[0]
+
+	// multirun writes to a terminal whose size the test controls.
+	master, slave, err := openPty()
+	if err != nil {
+		t.Skipf("No pty available: %v", err)
+	}
+	defer master.Close()
+	defer slave.Close()
+	setSize := func(rows, cols uint16) {
+		size := winsize{rows: rows, cols: cols}
+		if err := ioctl(slave.Fd(), syscall.TIOCSWINSZ, unsafe.Pointer(&size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setSize(30, 100)
+
+	cmd := exec.Command(testBin, "-pty", `sh -c 'trap "stty size" WINCH; stty size; while true; do sleep 0.05; done'`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	cmd.Stdout = slave
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start multirun: %v", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Signal(syscall.SIGTERM)
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(master)
+		for scanner.Scan() {
+			lines <- strings.TrimSpace(scanner.Text())
+		}
+	}()
+	expectLine := func(want string) {
+		t.Helper()
+		select {
+		case line := <-lines:
+			if line != want {
+				t.Errorf("Expected the child to see a size of %q, got %q", want, line)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for the child to print its size %q", want)
+		}
+	}
+	expectLine("30 100")
+
+	setSize(40, 120)
+	cmd.Process.Signal(syscall.SIGWINCH)
+	expectLine("40 120")
+}
+
+func TestForeignSIGKILLIsFlagged(t *testing.T) {
+	testBin := os.Args[0]
+	report := filepath.Join(t.TempDir(), "report.json")
+
+	cmd := exec.Command(testBin, "-report="+report, `sh -c 'kill -KILL $$'`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, _ := cmd.CombinedOutput()
+
+	if !strings.Contains(string(output), "possibly by the OOM killer") {
+		t.Errorf("Expected the SIGKILL to be flagged.\nOutput:\n%s", output)
+	}
+	data, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatalf("Failed to read the report: %v", err)
+	}
+	if !strings.Contains(string(data), `"possibleOOMKill": true`) {
+		t.Errorf("Expected the report to flag the SIGKILL, got:\n%s", data)
+	}
+}
+
+func TestFlagsFromEnv(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-ok-codes=0", `sh -c "exit 3"`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1", "MULTIRUN_VERBOSE=1", "MULTIRUN_OK_CODES=3")
+	output, err := cmd.CombinedOutput()
+
+	if err == nil {
+		t.Errorf("Expected the command line to take precedence over MULTIRUN_OK_CODES.\nOutput:\n%s", output)
+	}
+	if !strings.Contains(string(output), "launched command") {
+		t.Errorf("Expected MULTIRUN_VERBOSE to enable verbose mode.\nOutput:\n%s", output)
+	}
+
+	cmd = exec.Command(testBin, "true")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1", "MULTIRUN_GRACE=soon")
+	output, err = cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 2 || !strings.Contains(string(output), "MULTIRUN_GRACE: invalid value") {
+		t.Errorf("Expected exit code 2 on an invalid MULTIRUN_GRACE, got %v.\nOutput:\n%s", err, output)
+	}
+
+	// A multirun run as a command does not inherit the options of its
+	// parent.
+	cmd = exec.Command(testBin, `sh -c 'echo "[$MULTIRUN_KEEP_GOING]"'`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1", "MULTIRUN_KEEP_GOING=1")
+	output, err = cmd.CombinedOutput()
+
+	if err != nil || string(output) != "[]\n" {
+		t.Errorf("Expected MULTIRUN_KEEP_GOING to be removed from the environment, got %v.\nOutput:\n%s", err, output)
+	}
+}
+
+func TestRestartGroup(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-restart-group=2", `sh -c "echo run; exit 1"`, "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("Expected exit code 1, but got: %v", err)
+	}
+	if n := strings.Count(string(output), "run\n"); n != 3 {
+		t.Errorf("Expected the commands to run 3 times, got %d.\nOutput:\n%s", n, output)
+	}
+	if !strings.Contains(string(output), "stopped after sh failed, starting all the commands again (2 of 2)") {
+		t.Errorf("Expected every restart to be reported.\nOutput:\n%s", output)
+	}
+}
+
+func TestLeader(t *testing.T) {
+	testBin := os.Args[0]
+
+	// The failing helper is left alone, the exit of the leader stops the
+	// sleeping helper despite -keep-going.
+	start := time.Now()
+	cmd := exec.Command(testBin, "-leader=sh-2", "-keep-going", `sh -c "exit 1"`, `sh -c "sleep 0.3"`, "sleep 5")
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+	duration := time.Since(start)
+
+	if err != nil {
+		t.Errorf("Expected the failure of a helper to be ignored, but got: %v\nOutput:\n%s", err, output)
+	}
+	if duration < 300*time.Millisecond || duration > 2*time.Second {
+		t.Errorf("Expected multirun to stop once the leader exited, but it took %v\nOutput:\n%s", duration, output)
+	}
+}
+
+func TestExitCodePolicy(t *testing.T) {
+	testBin := os.Args[0]
+
+	for policy, want := range map[string]int{"": 1, "first": 3, "last": 5, "highest": 7} {
+		cmd := exec.Command(testBin, "-keep-going", "-exit-code-policy="+policy,
+			`sh -c "exit 3"`, `sh -c "sleep 0.1; exit 7"`, `sh -c "sleep 0.2; exit 5"`)
+		cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+		output, err := cmd.CombinedOutput()
+
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || exitErr.ExitCode() != want {
+			t.Errorf("Expected exit code %d with -exit-code-policy=%s, but got: %v\nOutput:\n%s", want, policy, err, output)
+		}
+	}
+}
+
+func TestNoCascade(t *testing.T) {
+	testBin := os.Args[0]
+
+	cmd := exec.Command(testBin, "-no-cascade", `sh -c "exit 3"`, `sh -c "sleep 0.3; echo done"`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("Expected exit code 1, but got: %v", err)
+	}
+	if !strings.Contains(string(output), "done") {
+		t.Errorf("Expected the other command to run to completion.\nOutput:\n%s", output)
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	testBin := os.Args[0]
+
+	start := time.Now()
+	cmd := exec.Command(testBin, "-keep-going", `sh -c "exit 3"`, "sleep 0.5", `sh -c "sleep 0.1; exit 4"`)
+	cmd.Env = append(os.Environ(), "GO_TEST_MODE_RUN_MAIN=1")
+	output, err := cmd.CombinedOutput()
+	duration := time.Since(start)
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("Expected exit code 1, but got: %v", err)
+	}
+	if duration < 500*time.Millisecond {
+		t.Errorf("Expected the survivors to run to completion, but multirun exited after %v", duration)
+	}
+	if !strings.Contains(string(output), "2 of 3 commands failed: sh (exit code 3), sh-2 (exit code 4)") {
+		t.Errorf("Expected every failure to be listed.\nOutput:\n%s", output)
+	}
+}